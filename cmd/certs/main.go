@@ -0,0 +1,176 @@
+// Package certs generates a local certificate authority and per-node certificates for securing RPCs between
+// workers and their clients.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	dir   = flag.String("dir", "certs", "The directory in which to find or create the CA and write certificates")
+	name  = flag.String("name", "", "The name of the node to create a certificate for. Only the CA is created if empty")
+	hosts = flag.String("hosts", "", "Comma-separated IP addresses and host names the node's certificate is valid for")
+	valid = flag.Duration("valid", 365*24*time.Hour, "How long certificates are valid for")
+)
+
+func serial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writePEM(path, kind string, b []byte, mode os.FileMode) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: b}), mode)
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "EC PRIVATE KEY", b, 0600)
+}
+
+func readPEM(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %q", path)
+	}
+	return block.Bytes, nil
+}
+
+// loadCA reads the CA from dir, creating it first if it does not exist.
+func loadCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath := filepath.Join(*dir, "ca.pem")
+	keyPath := filepath.Join(*dir, "ca.key")
+
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		glog.Infof("creating CA in %s", *dir)
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		sn, err := serial()
+		if err != nil {
+			return nil, nil, err
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          sn,
+			Subject:               pkix.Name{CommonName: "sprinkle CA"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(*valid),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := writeKey(keyPath, key); err != nil {
+			return nil, nil, err
+		}
+		if err := writePEM(certPath, "CERTIFICATE", der, 0644); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	der, err := readPEM(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	der, err = readPEM(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// issue writes a certificate and key for the named node, signed by the CA. The certificate may be used both to
+// serve RPCs and as a client certificate.
+func issue(ca *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	sn, err := serial()
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: sn,
+		Subject:      pkix.Name{CommonName: *name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(*valid),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, h := range strings.Split(*hosts, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	if err := writeKey(filepath.Join(*dir, *name+".key"), key); err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(*dir, *name+".pem"), "CERTIFICATE", der, 0644)
+}
+
+func main() {
+	flag.Parse()
+
+	if err := os.MkdirAll(*dir, 0700); err != nil {
+		glog.Exit("failed to create directory: ", err)
+	}
+
+	ca, caKey, err := loadCA()
+	if err != nil {
+		glog.Exit("failed to load CA: ", err)
+	}
+
+	if *name == "" {
+		return
+	}
+	if err := issue(ca, caKey); err != nil {
+		glog.Exit("failed to issue certificate: ", err)
+	}
+	glog.Infof("wrote %s.pem and %s.key to %s", *name, *name, *dir)
+}
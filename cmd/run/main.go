@@ -5,15 +5,15 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"math"
-	"net"
 	"os"
-	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/dominichamon/sprinkle/internal"
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/status"
 
 	pb "github.com/dominichamon/sprinkle/api/sprinkle"
 )
@@ -22,57 +22,254 @@ var (
 	cmd       = flag.String("cmd", "", "The command to run")
 	ram       = flag.Uint64("ram", 0, "The amount of RAM to reserve for the command")
 	wait      = flag.Bool("wait", true, "Whether to wait for the command to complete")
-	addr      = flag.String("addr", "239.192.0.1:9999", "The multicast address to use for discovery")
-	port      = flag.Int("port", 9998, "The port to listen on for discovery")
+	labelList = flag.String("labels", "", "Comma-separated key=value labels describing the job")
+	envList   = flag.String("env", "", "Comma-separated key=value environment variables to set for the command")
+	requires  = flag.String("constraints", "", "Comma-separated key=value labels a worker must have to run the command. An empty value matches any")
+	timeout   = flag.Duration("timeout", 0, "How long the command may run before it is cancelled. Unlimited if zero")
+	name      = flag.String("name", "", "An optional name for the job")
+	notes     = flag.String("annotations", "", "Comma-separated key=value notes about the job, which workers report back with it")
+	policy    = flag.Bool("policy", false, "Only check whether each discovered worker's admission policy would admit the command")
+
+	list  = flag.Bool("list", false, "List the jobs on the discovered workers, filtered by state, owner, since and labels, instead of running a command")
+	state = flag.String("state", "", "If set, only list jobs in this state: pending, running or complete")
+	owner = flag.String("owner", "", "If set, only list jobs submitted by this caller")
+	since = flag.Duration("since", 0, "If set, only list jobs that were running within this long")
+
+	drainList    = flag.String("drain", "", "Comma-separated host:port addresses of workers to drain, instead of running a command")
+	drainTimeout = flag.Duration("drain_timeout", 0, "How long drained workers wait for running jobs to complete before cancelling them. Defaults to each worker's drain_timeout")
+
+	addr      = flag.String("addr", "239.192.0.1:9999", "The multicast address to use for discovery. Multicast discovery is disabled if empty")
+	port      = flag.Int("port", 0, "The port to listen on for discovery acks. Defaults to an ephemeral port")
+	dtimeout  = flag.Duration("discovery_timeout", internal.DefaultDiscoveryTimeout, "How long to wait for workers to respond to discovery")
+	dlimit    = flag.Int("discovery_limit", 0, "If positive, stop discovery after finding this many workers")
+	discovery = flag.String("discovery", internal.MechanismMulticast, "Comma-separated discovery mechanisms to use: multicast, mdns")
+	iface     = flag.String("iface", "", "The interface to send discovery pings from. Defaults to the system's choice if unset")
+	cluster   = flag.String("cluster", internal.DefaultCluster, "The cluster whose workers to discover")
+	keyFile   = flag.String("discovery_key", "", "Path to a shared secret used to sign pings. If set, unsigned acks are ignored")
+	seeds     = flag.String("seeds", "", "Comma-separated host:port addresses of workers to ask for peers, in addition to multicast")
+	seedsFile = flag.String("seeds_file", "", "Path to a file of seed addresses, one per line")
 	retries   = flag.Int("retries", 3, "Number of times to retry running the command")
 	retryWait = flag.Duration("retry_wait", 10*time.Second, "time between retries")
-)
 
-func bestWorker(ctx context.Context, ram uint64, addrs <-chan string) *internal.Worker {
-	var worker *internal.Worker
-	bestFreeRam := uint64(math.Inf(1))
+	tlsCert = flag.String("tls_cert", "", "Path to the PEM client certificate to present to workers that require one")
+	tlsKey  = flag.String("tls_key", "", "Path to the PEM private key for tls_cert")
+	tlsCA   = flag.String("tls_ca", "", "Path to a PEM CA certificate to verify workers against. Connections are plaintext unless a TLS flag is set")
+
+	token     = flag.String("token", "", "The bearer token to present to workers. Defaults to $"+internal.TokenEnv+", then the contents of token_file")
+	tokenFile = flag.String("token_file", internal.DefaultTokenFile(), "Path to a file containing the bearer token to present to workers")
+)
 
-	for addr := range addrs {
-		glog.Infof("discovered worker at %s", addr)
+// bestWorker connects to the discovered worker best suited to the job.
+func bestWorker(ctx context.Context, ram uint64, constraints map[string]string, workers []internal.WorkerInfo) *internal.Worker {
+	conns := make(map[string]*internal.Worker)
+	var cs []internal.Candidate
+	for _, w := range workers {
+		addr := w.Addr
+		glog.Infof("discovered worker at %s via %s", addr, w.Source)
 
-		host, port, err := net.SplitHostPort(addr)
+		s, err := internal.DialWorker(addr)
 		if err != nil {
 			glog.Error(err)
 			continue
 		}
 
-		p, err := strconv.ParseInt(port, 10, 32)
+		stat, err := s.Client.Status(ctx, &pb.StatusRequest{})
 		if err != nil {
-			glog.Error(err)
+			glog.Errorf("failed to get status for %+v: %s", s, err)
+			s.Close()
 			continue
 		}
+		glog.Infof("Status of %s [%s]: %+v", s.Id, addr, stat)
+
+		conns[addr] = s
+		cs = append(cs, internal.Candidate{Addr: addr, Status: stat})
+	}
+
+	var worker *internal.Worker
+	if fit := internal.Schedule(cs, ram, constraints); len(fit) != 0 {
+		worker = conns[fit[0].Addr]
+	}
+	// Close out the workers not chosen.
+	for _, s := range conns {
+		if s != worker {
+			if err := s.Close(); err != nil {
+				glog.Warningf("failed to close worker: %s", err)
+			}
+		}
+	}
+	return worker
+}
+
+// discoverer returns the discovery mechanisms configured by flags.
+func discoverer() (internal.Discoverer, error) {
+	key, err := internal.LoadKey(*keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load discovery key: %s", err)
+	}
+
+	mechanisms, err := internal.ParseMechanisms(*discovery)
+	if err != nil {
+		return nil, err
+	}
 
-		s, err := internal.NewWorker(host, int(p))
+	ss, err := internal.ParseSeeds(*seeds, *seedsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse seeds: %s", err)
+	}
+
+	var ds []internal.Discoverer
+	if mechanisms[internal.MechanismMulticast] && *addr != "" {
+		ds = append(ds, &internal.Pinger{
+			Transport: &internal.Multicast{Addr: *addr, Port: *port, Iface: *iface},
+			Codec:     internal.NewCodec(*cluster, key),
+		})
+	}
+	if mechanisms[internal.MechanismMDNS] {
+		ds = append(ds, &internal.MDNS{Cluster: *cluster, Iface: *iface})
+	}
+	if len(ss) != 0 {
+		ds = append(ds, &internal.Seeds{Addrs: ss, Cluster: *cluster})
+	}
+	return internal.Merge(ds...), nil
+}
+
+// configureTLS sets up TLS for connections to workers if any of the TLS flags are set.
+func configureTLS() error {
+	files := internal.TLSFiles{Cert: *tlsCert, Key: *tlsKey, CA: *tlsCA}
+	if !files.Enabled() {
+		return nil
+	}
+
+	config, err := files.ClientConfig()
+	if err != nil {
+		return err
+	}
+	internal.SetClientTLS(config)
+	return nil
+}
+
+// request returns the RunRequest for the command given by flags.
+func request() (*pb.RunRequest, error) {
+	labels, err := internal.ParseLabels(*labelList)
+	if err != nil {
+		return nil, err
+	}
+	env, err := internal.ParseLabels(*envList)
+	if err != nil {
+		return nil, fmt.Errorf("invalid env: %s", err)
+	}
+	annotations, err := internal.ParseLabels(*notes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid annotations: %s", err)
+	}
+	return &pb.RunRequest{
+		Cmd:            *cmd,
+		Ram:            *ram,
+		Labels:         labels,
+		Env:            env,
+		TimeoutSeconds: int64(timeout.Seconds()),
+		Name:           *name,
+		Annotations:    annotations,
+	}, nil
+}
+
+// checkPolicy reports whether each worker would admit req, and returns false if none would.
+func checkPolicy(ctx context.Context, req *pb.RunRequest, workers []internal.WorkerInfo) bool {
+	req.DryRun = true
+	admitted := false
+	for _, w := range workers {
+		s, err := internal.DialWorker(w.Addr)
 		if err != nil {
-			glog.Error(err)
+			fmt.Printf("%s: %s\n", w.Addr, err)
 			continue
 		}
+		if _, err := s.Client.Run(ctx, req); err != nil {
+			fmt.Printf("%s: rejected: %s\n", w.Addr, status.Convert(err).Message())
+		} else {
+			fmt.Printf("%s: admitted\n", w.Addr)
+			admitted = true
+		}
+		if err := s.Close(); err != nil {
+			glog.Warningf("failed to close worker: %s", err)
+		}
+	}
+	return admitted
+}
 
-		stat, err := s.Client.Status(ctx, &pb.StatusRequest{})
+// drainWorkers asks each worker to drain, and returns false if any could not be.
+func drainWorkers(ctx context.Context, addrs []string) bool {
+	ok := true
+	for _, addr := range addrs {
+		s, err := internal.DialWorker(addr)
 		if err != nil {
-			glog.Errorf("failed to get status for %+v: %s", s, err)
+			fmt.Printf("%s: %s\n", addr, err)
+			ok = false
+			continue
 		}
-		glog.Infof("Status of %s [%s]: %+v", s.Id, addr, stat)
+		resp, err := s.Client.Drain(ctx, &pb.DrainRequest{TimeoutSeconds: int64(drainTimeout.Seconds())})
+		if err != nil {
+			fmt.Printf("%s: failed to drain: %s\n", addr, status.Convert(err).Message())
+			ok = false
+		} else {
+			fmt.Printf("%s: draining, %d jobs running until %s\n", addr, resp.Running,
+				time.Unix(resp.Deadline, 0).Format(time.RFC3339))
+		}
+		if err := s.Close(); err != nil {
+			glog.Warningf("failed to close worker: %s", err)
+		}
+	}
+	return ok
+}
 
-		if stat.FreeRam > ram {
-			if worker == nil || stat.FreeRam < bestFreeRam {
-				// Close out any worker we previously found
-				if worker != nil {
-					if err := worker.Close(); err != nil {
-						glog.Warningf("failed to close worker: %s", err)
-					}
-				}
-				worker = s
-				bestFreeRam = stat.FreeRam
+// listRequest returns the ListJobsRequest for the filter given by flags.
+func listRequest() (*pb.ListJobsRequest, error) {
+	req := &pb.ListJobsRequest{Owner: *owner}
+	if *state != "" {
+		s, ok := pb.JobResponse_State_value["STATE_"+strings.ToUpper(*state)]
+		if !ok {
+			return nil, fmt.Errorf("unknown state %q", *state)
+		}
+		req.State = pb.JobResponse_State(s)
+	}
+	if *since != 0 {
+		req.Since = time.Now().Add(-*since).Unix()
+	}
+	labels, err := internal.ParseLabels(*labelList)
+	if err != nil {
+		return nil, err
+	}
+	req.Labels = labels
+	return req, nil
+}
+
+// listJobs prints the jobs on each worker that match req.
+func listJobs(ctx context.Context, req *pb.ListJobsRequest, workers []internal.WorkerInfo) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "WORKER\tID\tNAME\tSTATE\tSUCCESS\tOWNER\tSTART\tEND\tCOMMAND")
+	for _, w := range workers {
+		s, err := internal.DialWorker(w.Addr)
+		if err != nil {
+			glog.Error(err)
+			continue
+		}
+		jrs, err := s.ListJobs(ctx, req)
+		if err != nil {
+			glog.Errorf("failed to list jobs on %s: %s", s.Id, err)
+		}
+		for _, j := range jrs {
+			end := "-"
+			if j.EndTime != 0 {
+				end = time.Unix(j.EndTime, 0).Format(time.RFC3339)
 			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%t\t%s\t%s\t%s\t%s\n", s.Id, j.Id, j.Request.GetName(),
+				strings.ToLower(strings.TrimPrefix(j.State.String(), "STATE_")), j.Success, j.Owner,
+				time.Unix(j.StartTime, 0).Format(time.RFC3339), end, j.Request.GetCmd())
+		}
+		if err := s.Close(); err != nil {
+			glog.Warningf("failed to close worker: %s", err)
 		}
 	}
-	return worker
+	tw.Flush()
 }
 
 func main() {
@@ -80,10 +277,61 @@ func main() {
 
 	ctx := context.Background()
 
+	if err := configureTLS(); err != nil {
+		glog.Exit("failed to configure TLS: ", err)
+	}
+
+	t, err := internal.LoadToken(*token, *tokenFile)
+	if err != nil {
+		glog.Exit("failed to load token: ", err)
+	}
+	internal.SetToken(t)
+
+	if *drainList != "" {
+		addrs, err := internal.ParseSeeds(*drainList, "")
+		if err != nil {
+			glog.Exit(err)
+		}
+		if !drainWorkers(ctx, addrs) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	d, err := discoverer()
+	if err != nil {
+		glog.Exit(err)
+	}
+
+	req, err := request()
+	if err != nil {
+		glog.Exit(err)
+	}
+	constraints, err := internal.ParseLabels(*requires)
+	if err != nil {
+		glog.Exit("invalid constraints: ", err)
+	}
+
 	// Discover best worker.
-	addrs := make(chan string)
-	if err := internal.Ping(*addr, *port, addrs); err != nil {
-		glog.Exit("failed to find workers: +v", err)
+	workers, err := d.Discover(ctx, internal.DiscoverOptions{Timeout: *dtimeout, Limit: *dlimit})
+	if err != nil {
+		glog.Exit("failed to find workers: ", err)
+	}
+
+	if *list {
+		lreq, err := listRequest()
+		if err != nil {
+			glog.Exit(err)
+		}
+		listJobs(ctx, lreq, workers)
+		return
+	}
+
+	if *policy {
+		if !checkPolicy(ctx, req, workers) {
+			os.Exit(1)
+		}
+		return
 	}
 
 	var worker *internal.Worker
@@ -96,10 +344,10 @@ func main() {
 				glog.Warningf("failed to close worker: %s", err)
 			}
 		}
-		worker = bestWorker(ctx, *ram, addrs)
+		worker = bestWorker(ctx, *ram, constraints, workers)
 		if worker == nil {
 			errs = append(errs, fmt.Errorf("failed to identify best worker"))
-			time.Sleep(*retryWait)
+			waitForCapacity(ctx, workers, *retryWait)
 			continue
 		}
 
@@ -107,10 +355,7 @@ func main() {
 
 		// Run command.
 		var err error
-		resp, err = worker.Client.Run(ctx, &pb.RunRequest{
-			Cmd: *cmd,
-			Ram: *ram,
-		})
+		resp, err = worker.Client.Run(ctx, req)
 		if err != nil {
 			errs = append(errs, fmt.Errorf("failed to run command: %s", err))
 			time.Sleep(*retryWait)
@@ -119,8 +364,8 @@ func main() {
 		break
 	}
 
-	if len(errs) != 0 {
-		for e := range errs {
+	if resp == nil {
+		for _, e := range errs {
 			glog.Errorln(e)
 		}
 		glog.Exit()
@@ -135,8 +380,7 @@ func main() {
 	job := resp.JobId
 	glog.Infof("running job %d on worker %q", job, worker.Id)
 	if *wait {
-		// no need to check on the job as the logs stream until the job
-		// is complete.
+		// The logs stream until the job is complete.
 		stream, err := worker.Client.Logs(ctx, &pb.LogsRequest{JobId: job})
 		if err != nil {
 			glog.Exit(err)
@@ -159,5 +403,16 @@ func main() {
 				fmt.Fprint(os.Stderr, chunk.Chunk)
 			}
 		}
+
+		j, reason, err := jobResult(ctx, worker, resp)
+		if err != nil {
+			glog.Exit(err)
+		}
+		if reason != "" {
+			glog.Exitf("job %d was cancelled: %s", job, reason)
+		}
+		if !j.Success {
+			glog.Exitf("job %d failed", job)
+		}
 	}
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dominichamon/sprinkle/internal"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+// waitForCapacity waits until one of the workers finishes a job or recovers from being overloaded, either of
+// which may leave room for the command, or until the timeout passes.
+func waitForCapacity(ctx context.Context, workers []internal.WorkerInfo, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	freed := make(chan string, len(workers))
+	for _, w := range workers {
+		s, err := internal.DialWorker(w.Addr)
+		if err != nil {
+			glog.Error(err)
+			continue
+		}
+		defer s.Close()
+
+		stream, err := s.Client.Watch(ctx, &pb.WatchRequest{})
+		if err != nil {
+			glog.Warningf("failed to watch %s: %s", s.Id, err)
+			continue
+		}
+		go func(id string) {
+			for {
+				e, err := stream.Recv()
+				if err != nil {
+					return
+				}
+				switch {
+				case e.Type == pb.WatchEvent_TYPE_JOB_FINISHED,
+					e.Type == pb.WatchEvent_TYPE_RESOURCE_THRESHOLD && !e.Exceeded:
+					freed <- id
+					return
+				}
+			}
+		}(s.Id)
+	}
+
+	select {
+	case id := <-freed:
+		glog.Infof("capacity may have freed up on %s", id)
+	case <-ctx.Done():
+	}
+}
+
+// jobResult waits for the job to finish, returning its final state and why it was cancelled, if it was. It
+// watches from the token returned when the job started so that it cannot miss the job finishing, falling
+// back to asking for the job's state if it can't watch.
+func jobResult(ctx context.Context, worker *internal.Worker, resp *pb.RunResponse) (*pb.JobResponse, string, error) {
+	var reason string
+	stream, err := worker.Client.Watch(ctx, &pb.WatchRequest{ResumeToken: resp.WatchToken, JobId: resp.JobId})
+	if err == nil {
+		for {
+			var e *pb.WatchEvent
+			if e, err = stream.Recv(); err != nil {
+				break
+			}
+			switch e.Type {
+			case pb.WatchEvent_TYPE_JOB_CANCELLED:
+				reason = e.Reason
+			case pb.WatchEvent_TYPE_JOB_FINISHED:
+				return e.Job, reason, nil
+			}
+		}
+	}
+	glog.Warningf("failed to watch job %d: %s", resp.JobId, err)
+
+	j, err := worker.Client.Job(ctx, &pb.JobRequest{Id: resp.JobId})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get job %d: %s", resp.JobId, err)
+	}
+	return j, reason, nil
+}
@@ -0,0 +1,44 @@
+// Actions that change the state of the cluster, shared by the UI's pages. Requests carry the CSRF token from
+// the page, and the UI presents the token of the user signed in to it to the workers.
+"use strict";
+
+// post sends body to the JSON API and returns the decoded response, throwing an Error with the server's
+// message on failure.
+async function post(path, body) {
+	const headers = {
+		"Content-Type": "application/json",
+		"X-CSRF-Token": document.querySelector("meta[name=csrf-token]").content,
+	};
+	const resp = await fetch("/api/v1/" + path, {
+		method: "POST",
+		headers: headers,
+		body: JSON.stringify(body || {}),
+	});
+	const data = await resp.json();
+	if (!resp.ok) {
+		throw new Error(data.error || resp.statusText);
+	}
+	return data;
+}
+
+function jobPath(worker, id) {
+	return "jobs/" + encodeURIComponent(worker) + "/" + id;
+}
+
+function cancelJob(worker, id) {
+	return post(jobPath(worker, id) + "/cancel");
+}
+
+function rerunJob(worker, id) {
+	return post(jobPath(worker, id) + "/rerun");
+}
+
+// signIn keeps the user's token in a cookie that the page's scripts can't read, or signs out if it is empty.
+function signIn(token) {
+	return post("login", {token: token});
+}
+
+async function signedIn() {
+	const resp = await fetch("/api/v1/login");
+	return resp.ok && (await resp.json()).signed_in;
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+// apiPrefix is the prefix of the current version of the JSON API. It is also served without the version for
+// convenience.
+const apiPrefix = "/api/v1/"
+
+// apiWorker is a worker as presented by the JSON API.
+type apiWorker struct {
+	ID       string            `json:"id"`
+	Hostname string            `json:"hostname"`
+	IP       string            `json:"ip"`
+	TotalRAM uint64            `json:"total_ram"`
+	FreeRAM  uint64            `json:"free_ram"`
+	Load     float64           `json:"load"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Version  string            `json:"version,omitempty"`
+	Draining bool              `json:"draining"`
+	Jobs     []int64           `json:"jobs"`
+}
+
+// apiUsage is the resource usage of a completed job as presented by the JSON API.
+type apiUsage struct {
+	UserSec   float64 `json:"user_sec"`
+	SystemSec float64 `json:"system_sec"`
+	MaxRSS    int64   `json:"max_rss"`
+}
+
+// apiSample is the resource usage of a running job at a point in time as presented by the JSON API.
+type apiSample struct {
+	Time       int64   `json:"t"`
+	Processes  int32   `json:"processes"`
+	RSS        uint64  `json:"rss"`
+	CPUPercent float64 `json:"cpu_percent"`
+	Threads    int32   `json:"threads"`
+	OpenFDs    int32   `json:"open_fds"`
+	ReadBytes  uint64  `json:"read_bytes"`
+	WriteBytes uint64  `json:"write_bytes"`
+}
+
+func newAPISample(s *pb.ResourceSample) apiSample {
+	return apiSample{
+		Time:       s.Time,
+		Processes:  s.Processes,
+		RSS:        s.Rss,
+		CPUPercent: s.CpuPercent,
+		Threads:    s.Threads,
+		OpenFDs:    s.OpenFds,
+		ReadBytes:  s.ReadBytes,
+		WriteBytes: s.WriteBytes,
+	}
+}
+
+// latestSample returns the most recent resource sample of a job, or nil if it has none.
+func latestSample(j *pb.JobResponse) *pb.ResourceSample {
+	if n := len(j.GetSamples()); n > 0 {
+		return j.Samples[n-1]
+	}
+	return nil
+}
+
+// apiJob is a job as presented by the JSON API.
+type apiJob struct {
+	Worker    string    `json:"worker"`
+	ID        int64     `json:"id"`
+	State     string    `json:"state"`
+	Success   bool      `json:"success"`
+	Owner     string    `json:"owner,omitempty"`
+	Cmd       string    `json:"cmd,omitempty"`
+	StartTime int64     `json:"start_time"`
+	EndTime   int64     `json:"end_time,omitempty"`
+	Usage     *apiUsage `json:"usage,omitempty"`
+	// Sample is the latest resource usage sampled while the job runs.
+	Sample *apiSample `json:"sample,omitempty"`
+	// Rerunnable is set for jobs that can be run again: by their submitter if submitted through the UI, and by
+	// anyone if the worker echoed their request in full.
+	Rerunnable bool `json:"rerunnable"`
+
+	// The request that started the job, if the worker reported it.
+	Name          string            `json:"name,omitempty"`
+	RAM           uint64            `json:"ram"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+	EnvKeys       []string          `json:"env_keys,omitempty"`
+	Argv          []string          `json:"argv,omitempty"`
+	Timeout       int64             `json:"timeout_seconds,omitempty"`
+	SubmitTime    int64             `json:"submit_time,omitempty"`
+	SubmittedFrom string            `json:"submitted_from,omitempty"`
+}
+
+func stateName(s pb.JobResponse_State) string {
+	return strings.ToLower(strings.TrimPrefix(s.String(), "STATE_"))
+}
+
+func seconds(t *pb.Timeval) float64 {
+	return float64(t.GetSec()) + float64(t.GetUsec())/1e6
+}
+
+func newAPIJob(worker string, id int64, j *pb.JobResponse) apiJob {
+	a := apiJob{
+		Worker:    worker,
+		ID:        id,
+		State:     stateName(j.State),
+		Success:   j.Success,
+		Owner:     j.Owner,
+		Cmd:       j.Request.GetCmd(),
+		StartTime: j.StartTime,
+		EndTime:   j.EndTime,
+
+		Rerunnable: rerunnable(worker, id, j),
+
+		Name:          j.Request.GetName(),
+		RAM:           j.Request.GetRam(),
+		Labels:        j.Request.GetLabels(),
+		Annotations:   j.Request.GetAnnotations(),
+		EnvKeys:       j.EnvKeys,
+		Argv:          j.Argv,
+		Timeout:       j.Request.GetTimeoutSeconds(),
+		SubmitTime:    j.SubmitTime,
+		SubmittedFrom: j.SubmittedFrom,
+	}
+	if j.Rusage != nil {
+		a.Usage = &apiUsage{
+			UserSec:   seconds(j.Rusage.Utime),
+			SystemSec: seconds(j.Rusage.Stime),
+			MaxRSS:    j.Rusage.Maxrss,
+		}
+	}
+	if s := latestSample(j); s != nil {
+		smp := newAPISample(s)
+		a.Sample = &smp
+	}
+	return a
+}
+
+// newAPIWorker must be called with status and jobs locked for reading.
+func newAPIWorker(id string, s *pb.StatusResponse) apiWorker {
+	a := apiWorker{
+		ID:       id,
+		Hostname: s.Hostname,
+		IP:       s.Ip,
+		TotalRAM: s.TotalRam,
+		FreeRAM:  s.FreeRam,
+		Load:     s.Load,
+		Labels:   s.Labels,
+		Version:  s.Version,
+		Draining: s.Draining,
+		Jobs:     []int64{},
+	}
+	for jid := range jobs.jobs[id] {
+		a.Jobs = append(a.Jobs, jid)
+	}
+	sort.Slice(a.Jobs, func(i, j int) bool { return a.Jobs[i] < a.Jobs[j] })
+	return a
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Error(err)
+	}
+}
+
+func apiError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// api serves the JSON API, routing on the path after the API prefix.
+func api(w http.ResponseWriter, req *http.Request) {
+	p := strings.TrimPrefix(req.URL.Path, apiPrefix)
+	if p == req.URL.Path {
+		p = strings.TrimPrefix(req.URL.Path, "/api/")
+	}
+	p = strings.Trim(p, "/")
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := checkCSRF(req); err != nil {
+			apiError(w, http.StatusForbidden, err)
+			return
+		}
+		if p == "login" {
+			apiLogin(w, req)
+		} else if p == "jobs" {
+			apiSubmit(w, req)
+		} else if strings.HasPrefix(p, "jobs/") {
+			apiJobAction(w, req, strings.TrimPrefix(p, "jobs/"))
+		} else {
+			apiError(w, http.StatusNotFound, fmt.Errorf("unknown endpoint %q", req.URL.Path))
+		}
+		return
+	default:
+		apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+
+	switch {
+	case p == "workers":
+		apiWorkers(w, req)
+	case strings.HasPrefix(p, "workers/"):
+		apiWorkerByID(w, strings.TrimPrefix(p, "workers/"))
+	case p == "jobs":
+		apiJobs(w, req)
+	case strings.HasPrefix(p, "jobs/"):
+		apiJobByID(w, strings.TrimPrefix(p, "jobs/"))
+	case p == "history":
+		apiHistory(w, req)
+	case p == "login":
+		writeJSON(w, http.StatusOK, map[string]bool{"signed_in": userToken(req) != ""})
+	default:
+		apiError(w, http.StatusNotFound, fmt.Errorf("unknown endpoint %q", req.URL.Path))
+	}
+}
+
+func apiWorkers(w http.ResponseWriter, _ *http.Request) {
+	status.RLock()
+	defer status.RUnlock()
+	jobs.RLock()
+	defer jobs.RUnlock()
+
+	ws := []apiWorker{}
+	for id, s := range status.status {
+		if s != nil {
+			ws = append(ws, newAPIWorker(id, s))
+		}
+	}
+	sort.Slice(ws, func(i, j int) bool { return ws[i].ID < ws[j].ID })
+	writeJSON(w, http.StatusOK, ws)
+}
+
+func apiWorkerByID(w http.ResponseWriter, id string) {
+	status.RLock()
+	defer status.RUnlock()
+	jobs.RLock()
+	defer jobs.RUnlock()
+
+	s, ok := status.status[id]
+	if !ok || s == nil {
+		apiError(w, http.StatusNotFound, fmt.Errorf("worker %q not found", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIWorker(id, s))
+}
+
+// apiJobs lists jobs across all workers, optionally filtered by the worker and state query parameters.
+func apiJobs(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	wantWorker := q.Get("worker")
+	wantState := q.Get("state")
+
+	jobs.RLock()
+	defer jobs.RUnlock()
+
+	js := []apiJob{}
+	for wid, jrs := range jobs.jobs {
+		if wantWorker != "" && wid != wantWorker {
+			continue
+		}
+		for jid, j := range jrs {
+			if wantState != "" && stateName(j.State) != wantState {
+				continue
+			}
+			js = append(js, newAPIJob(wid, jid, j))
+		}
+	}
+	sort.Slice(js, func(i, j int) bool {
+		if js[i].Worker != js[j].Worker {
+			return js[i].Worker < js[j].Worker
+		}
+		return js[i].ID < js[j].ID
+	})
+	writeJSON(w, http.StatusOK, js)
+}
+
+// apiJobByID serves a single job given a path of the form worker/id.
+func apiJobByID(w http.ResponseWriter, p string) {
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		apiError(w, http.StatusBadRequest, errors.New("expected /jobs/{worker}/{id}"))
+		return
+	}
+	wid := p[:i]
+	jid, err := strconv.ParseInt(p[i+1:], 10, 64)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("bad job id: %s", err))
+		return
+	}
+
+	jobs.RLock()
+	defer jobs.RUnlock()
+
+	j, ok := jobs.jobs[wid][jid]
+	if !ok {
+		apiError(w, http.StatusNotFound, fmt.Errorf("job %d not found on worker %q", jid, wid))
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIJob(wid, jid, j))
+}
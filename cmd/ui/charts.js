@@ -0,0 +1,32 @@
+// Charts shared by the UI's pages.
+"use strict";
+
+const svgNS = "http://www.w3.org/2000/svg";
+const sparkWidth = 200;
+const sparkHeight = 30;
+
+// sparkline plots a value of each sample over time, scaled from zero to the larger of limit and the
+// largest value, followed by the latest value.
+function sparkline(samples, value, limit, from, to, format) {
+	const max = Math.max(limit, ...samples.map(value));
+	const svg = document.createElementNS(svgNS, "svg");
+	svg.setAttribute("class", "sparkline");
+	svg.setAttribute("width", sparkWidth);
+	svg.setAttribute("height", sparkHeight);
+	const line = document.createElementNS(svgNS, "polyline");
+	line.setAttribute("points", samples.map(function (s) {
+		const x = to > from ? (s.t - from) / (to - from) * sparkWidth : sparkWidth;
+		const y = sparkHeight - (max > 0 ? value(s) / max : 0) * (sparkHeight - 2) - 1;
+		return x.toFixed(1) + "," + y.toFixed(1);
+	}).join(" "));
+	svg.appendChild(line);
+	const title = document.createElementNS(svgNS, "title");
+	title.textContent = "peak " + format(Math.max(0, ...samples.map(value)));
+	svg.appendChild(title);
+
+	const span = document.createElement("span");
+	span.appendChild(svg);
+	const last = samples.length ? format(value(samples[samples.length - 1])) : "-";
+	span.appendChild(document.createTextNode(" " + last));
+	return span;
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var events hub
+
+// event is a server-sent event.
+type event struct {
+	name string
+	data []byte
+}
+
+func newEvent(name string, v interface{}) (event, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return event{}, err
+	}
+	return event{name: name, data: b}, nil
+}
+
+// hub tracks what has been sent to browsers and fans out changes to them.
+type hub struct {
+	sync.Mutex
+	subs    map[chan event]bool
+	workers map[string]apiWorker
+	jobs    map[string]apiJob
+}
+
+func init() {
+	events.Lock()
+	events.subs = make(map[chan event]bool)
+	events.workers = make(map[string]apiWorker)
+	events.jobs = make(map[string]apiJob)
+	events.Unlock()
+}
+
+func jobKey(j apiJob) string {
+	return fmt.Sprintf("%s/%d", j.Worker, j.ID)
+}
+
+// snapshot returns the current state of all workers and jobs, which must be locked for reading.
+func snapshot() (map[string]apiWorker, map[string]apiJob) {
+	ws := make(map[string]apiWorker)
+	for id, s := range status.status {
+		if s != nil {
+			ws[id] = newAPIWorker(id, s)
+		}
+	}
+	js := make(map[string]apiJob)
+	for wid, jrs := range jobs.jobs {
+		for jid, j := range jrs {
+			a := newAPIJob(wid, jid, j)
+			js[jobKey(a)] = a
+		}
+	}
+	return ws, js
+}
+
+// publish sends events to all subscribers for anything that changed since the last call.
+func (h *hub) publish() {
+	// The snapshot is taken while holding the hub's lock so that concurrent publishers compare and record
+	// snapshots in the order they were taken, and an older one never replaces a newer one.
+	h.Lock()
+	defer h.Unlock()
+	status.RLock()
+	jobs.RLock()
+	ws, js := snapshot()
+	jobs.RUnlock()
+	status.RUnlock()
+
+	var evs []event
+	add := func(name string, v interface{}) {
+		e, err := newEvent(name, v)
+		if err != nil {
+			glog.Error(err)
+			return
+		}
+		evs = append(evs, e)
+	}
+
+	for id, w := range ws {
+		if old, ok := h.workers[id]; !ok || !reflect.DeepEqual(old, w) {
+			add("worker", w)
+		}
+	}
+	for id := range h.workers {
+		if _, ok := ws[id]; !ok {
+			add("worker_removed", map[string]string{"id": id})
+		}
+	}
+	for k, j := range js {
+		if old, ok := h.jobs[k]; !ok || !reflect.DeepEqual(old, j) {
+			add("job", j)
+		}
+	}
+	for k, j := range h.jobs {
+		if _, ok := js[k]; !ok {
+			add("job_removed", map[string]interface{}{"worker": j.Worker, "id": j.ID})
+		}
+	}
+	h.workers, h.jobs = ws, js
+
+	for ch := range h.subs {
+	send:
+		for _, e := range evs {
+			select {
+			case ch <- e:
+			default:
+				// The browser is not keeping up. Dropping it makes it reconnect and start again from a snapshot.
+				delete(h.subs, ch)
+				close(ch)
+				break send
+			}
+		}
+	}
+}
+
+// subscribe returns a channel of events, starting with a snapshot of everything published so far.
+func (h *hub) subscribe() (chan event, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	snap := struct {
+		Workers []apiWorker `json:"workers"`
+		Jobs    []apiJob    `json:"jobs"`
+	}{[]apiWorker{}, []apiJob{}}
+	for _, w := range h.workers {
+		snap.Workers = append(snap.Workers, w)
+	}
+	for _, j := range h.jobs {
+		snap.Jobs = append(snap.Jobs, j)
+	}
+	e, err := newEvent("snapshot", snap)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan event, 256)
+	ch <- e
+	h.subs[ch] = true
+	return ch, nil
+}
+
+func (h *hub) unsubscribe(ch chan event) {
+	h.Lock()
+	defer h.Unlock()
+	if h.subs[ch] {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// eventStream serves worker and job changes as server-sent events.
+func eventStream(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch, err := events.subscribe()
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	// Comments keep the connection alive through proxies and let the browser notice when it drops.
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.name, e.data); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+var (
+	historySize = flag.Int("history_size", 8640, "The number of status samples to keep per worker. The default covers a day at the default status_poll")
+	historyFile = flag.String("history_file", "", "Path to a file in which to keep status samples across restarts. Samples are only kept in memory if empty")
+
+	history historyMap
+)
+
+// sample is the status of a worker, or the sum over all workers, at a point in time.
+type sample struct {
+	Time     int64   `json:"t"`
+	Load     float64 `json:"load"`
+	FreeRAM  uint64  `json:"free_ram"`
+	TotalRAM uint64  `json:"total_ram"`
+	Running  int     `json:"running"`
+}
+
+// ring holds the most recent samples for a worker, oldest first once it wraps.
+type ring struct {
+	samples []sample
+	next    int
+}
+
+func (r *ring) add(s sample) {
+	if len(r.samples) < *historySize {
+		r.samples = append(r.samples, s)
+		return
+	}
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+}
+
+// latest returns the most recent sample. The ring must not be empty.
+func (r *ring) latest() sample {
+	return r.samples[(r.next+len(r.samples)-1)%len(r.samples)]
+}
+
+// since returns the samples taken at or after t, oldest first.
+func (r *ring) since(t int64) []sample {
+	var ss []sample
+	for i := range r.samples {
+		s := r.samples[(r.next+i)%len(r.samples)]
+		if s.Time >= t {
+			ss = append(ss, s)
+		}
+	}
+	return ss
+}
+
+// historyMap holds the recent samples of every worker, and the file they are kept in, if any.
+type historyMap struct {
+	sync.RWMutex
+	workers map[string]*ring
+	file    *os.File
+	// appended counts the samples written to file since it was last compacted.
+	appended int
+}
+
+func init() {
+	history.Lock()
+	history.workers = make(map[string]*ring)
+	history.Unlock()
+}
+
+// diskSample is a sample as kept in the history file.
+type diskSample struct {
+	Worker string `json:"worker"`
+	sample
+}
+
+func (h *historyMap) add(worker string, s sample) {
+	r, ok := h.workers[worker]
+	if !ok {
+		r = &ring{}
+		h.workers[worker] = r
+	}
+	r.add(s)
+}
+
+// setupHistory loads samples kept by a previous run and opens the history file to keep new ones.
+func setupHistory() error {
+	if *historySize <= 0 {
+		return fmt.Errorf("history_size must be positive")
+	}
+	if *historyFile == "" {
+		return nil
+	}
+
+	history.Lock()
+	defer history.Unlock()
+
+	f, err := os.Open(*historyFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var s diskSample
+			if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+				glog.Warningf("skipping bad sample in %s: %s", *historyFile, err)
+				continue
+			}
+			history.add(s.Worker, s.sample)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return history.compact()
+}
+
+// compact rewrites the history file with only the samples that are still kept. It must be called with the
+// lock held.
+func (h *historyMap) compact() error {
+	tmp := *historyFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for id, r := range h.workers {
+		for _, s := range r.since(0) {
+			if err := enc.Encode(diskSample{Worker: id, sample: s}); err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, *historyFile); err != nil {
+		f.Close()
+		return err
+	}
+
+	if h.file != nil {
+		h.file.Close()
+	}
+	h.file = f
+	h.appended = 0
+	return nil
+}
+
+// retention is how long samples are kept at the configured status poll.
+func retention() time.Duration {
+	return time.Duration(*historySize) * *statusPoll
+}
+
+// takeSamples samples the status and running jobs of every worker, which must be locked for reading.
+func takeSamples(now time.Time) map[string]sample {
+	samples := make(map[string]sample)
+	for id, s := range status.status {
+		if s == nil {
+			continue
+		}
+		smp := sample{
+			Time:     now.Unix(),
+			Load:     s.Load,
+			FreeRAM:  s.FreeRam,
+			TotalRAM: s.TotalRam,
+		}
+		for _, j := range jobs.jobs[id] {
+			if j.State == pb.JobResponse_STATE_RUNNING {
+				smp.Running++
+			}
+		}
+		samples[id] = smp
+	}
+	return samples
+}
+
+// record keeps samples taken at now, and forgets workers that have not been sampled for longer than samples are
+// kept.
+func (h *historyMap) record(now time.Time, samples map[string]sample) {
+	h.Lock()
+	defer h.Unlock()
+
+	var pruned bool
+	for id, r := range h.workers {
+		if _, ok := samples[id]; !ok && now.Sub(time.Unix(r.latest().Time, 0)) > retention() {
+			delete(h.workers, id)
+			pruned = true
+		}
+	}
+
+	var kept int
+	enc := json.NewEncoder(h.file)
+	for id, smp := range samples {
+		h.add(id, smp)
+		kept += len(h.workers[id].samples)
+
+		if h.file != nil {
+			if err := enc.Encode(diskSample{Worker: id, sample: smp}); err != nil {
+				glog.Errorf("failed to write history: %s", err)
+			}
+			h.appended++
+		}
+	}
+
+	// Let the file grow to twice what is kept before dropping the samples that have been overwritten. Workers that
+	// have gone are dropped at once.
+	if h.file != nil && (pruned || h.appended > kept) {
+		if err := h.compact(); err != nil {
+			glog.Errorf("failed to compact history: %s", err)
+		}
+	}
+}
+
+// clusterSeries sums samples taken at the same time across workers.
+func clusterSeries(series map[string][]sample) []sample {
+	byTime := make(map[int64]*sample)
+	for _, ss := range series {
+		for _, s := range ss {
+			c, ok := byTime[s.Time]
+			if !ok {
+				c = &sample{Time: s.Time}
+				byTime[s.Time] = c
+			}
+			c.Load += s.Load
+			c.FreeRAM += s.FreeRAM
+			c.TotalRAM += s.TotalRAM
+			c.Running += s.Running
+		}
+	}
+	cluster := make([]sample, 0, len(byTime))
+	for _, c := range byTime {
+		cluster = append(cluster, *c)
+	}
+	sort.Slice(cluster, func(i, j int) bool { return cluster[i].Time < cluster[j].Time })
+	return cluster
+}
+
+// downsample averages samples into at most n buckets of equal time between from and to.
+func downsample(ss []sample, from, to int64, n int) []sample {
+	if n <= 0 || len(ss) <= n || to <= from {
+		return ss
+	}
+	width := float64(to-from) / float64(n)
+	var out []sample
+	var sum sample
+	var count, bucket int
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		out = append(out, sample{
+			Time:     sum.Time / int64(count),
+			Load:     sum.Load / float64(count),
+			FreeRAM:  sum.FreeRAM / uint64(count),
+			TotalRAM: sum.TotalRAM / uint64(count),
+			Running:  (sum.Running + count/2) / count,
+		})
+		sum, count = sample{}, 0
+	}
+	for _, s := range ss {
+		if b := int(float64(s.Time-from) / width); b != bucket {
+			flush()
+			bucket = b
+		}
+		sum.Time += s.Time
+		sum.Load += s.Load
+		sum.FreeRAM += s.FreeRAM
+		sum.TotalRAM += s.TotalRAM
+		sum.Running += s.Running
+		count++
+	}
+	flush()
+	return out
+}
+
+// apiHistory serves the samples taken over the duration given by since, by default the last hour, for each
+// worker and summed over the cluster. If points is set, each series is averaged down to at most that many
+// samples.
+func apiHistory(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	window := time.Hour
+	if v := q.Get("since"); v != "" {
+		var err error
+		if window, err = time.ParseDuration(v); err != nil || window <= 0 {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("bad since %q", v))
+			return
+		}
+	}
+	points := 0
+	if v := q.Get("points"); v != "" {
+		var err error
+		if points, err = strconv.Atoi(v); err != nil || points < 0 {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("bad points %q", v))
+			return
+		}
+	}
+	wid := q.Get("worker")
+
+	now := time.Now()
+	from := now.Add(-window).Unix()
+
+	history.RLock()
+	series := make(map[string][]sample)
+	for id, r := range history.workers {
+		if wid != "" && id != wid {
+			continue
+		}
+		if ss := r.since(from); len(ss) != 0 {
+			series[id] = ss
+		}
+	}
+	history.RUnlock()
+
+	resp := struct {
+		From    int64               `json:"from"`
+		To      int64               `json:"to"`
+		Cluster []sample            `json:"cluster"`
+		Workers map[string][]sample `json:"workers"`
+	}{
+		From:    from,
+		To:      now.Unix(),
+		Cluster: downsample(clusterSeries(series), from, now.Unix(), points),
+		Workers: make(map[string][]sample),
+	}
+	for id, ss := range series {
+		resp.Workers[id] = downsample(ss, from, now.Unix(), points)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/dominichamon/sprinkle/internal"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+const (
+	// defaultPageSize is the number of log lines returned per page unless another limit is requested.
+	defaultPageSize = 1000
+	maxPageSize     = 10000
+)
+
+// apiLine is a line of a job's output as presented to the browser.
+type apiLine struct {
+	Line int64  `json:"line"`
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+func newAPILine(r *pb.LogsResponse) apiLine {
+	return apiLine{Line: r.Line, Type: strings.ToLower(r.Type.String()), Text: r.Chunk}
+}
+
+// parseJobPath splits a path of the form worker/id into its parts.
+func parseJobPath(p string) (string, int64, error) {
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		return "", 0, errors.New("expected {worker}/{id}")
+	}
+	id, err := strconv.ParseInt(p[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("bad job id: %s", err)
+	}
+	return p[:i], id, nil
+}
+
+func lookupWorker(id string) (*internal.Worker, bool) {
+	worker.RLock()
+	defer worker.RUnlock()
+	s, ok := worker.worker[id]
+	return s, ok
+}
+
+// jobPage serves the job detail page and its logs, routing on the path after /jobs/.
+func jobPage(w http.ResponseWriter, req *http.Request) {
+	p := strings.TrimPrefix(req.URL.Path, "/jobs/")
+
+	var handler func(http.ResponseWriter, *http.Request, *internal.Worker, int64)
+	switch {
+	case strings.HasSuffix(p, "/logs/stream"):
+		p, handler = strings.TrimSuffix(p, "/logs/stream"), logStream
+	case strings.HasSuffix(p, "/logs/download"):
+		p, handler = strings.TrimSuffix(p, "/logs/download"), logDownload
+	case strings.HasSuffix(p, "/logs"):
+		p, handler = strings.TrimSuffix(p, "/logs"), logPage
+	case strings.HasSuffix(p, "/samples"):
+		p, handler = strings.TrimSuffix(p, "/samples"), jobSamples
+	default:
+		handler = jobDetail
+	}
+
+	wid, id, err := parseJobPath(p)
+	if err != nil {
+		handleError(w, http.StatusBadRequest, err)
+		return
+	}
+	s, ok := lookupWorker(wid)
+	if !ok {
+		handleError(w, http.StatusNotFound, fmt.Errorf("worker %q not found", wid))
+		return
+	}
+	handler(w, req, s, id)
+}
+
+func jobDetail(w http.ResponseWriter, req *http.Request, s *internal.Worker, id int64) {
+	j, err := s.Client.Job(req.Context(), &pb.JobRequest{Id: id})
+	if err != nil {
+		handleError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	data := struct {
+		CSRF     string
+		Worker   string
+		ID       int64
+		Base     string
+		Job      *pb.JobResponse
+		State    string
+		Running  bool
+		PageSize int
+	}{
+		CSRF:     csrfToken(w, req),
+		Worker:   s.Id,
+		ID:       id,
+		Base:     fmt.Sprintf("/jobs/%s/%d", url.PathEscape(s.Id), id),
+		Job:      j,
+		State:    stateName(j.State),
+		Running:  j.State != pb.JobResponse_STATE_COMPLETE,
+		PageSize: defaultPageSize,
+	}
+	if err := jobTmpl.Execute(w, data); err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// jobSamples serves the job and all the resource samples its worker keeps for it as JSON.
+func jobSamples(w http.ResponseWriter, req *http.Request, s *internal.Worker, id int64) {
+	j, err := s.Client.Job(req.Context(), &pb.JobRequest{Id: id})
+	if err != nil {
+		apiError(w, http.StatusBadGateway, err)
+		return
+	}
+	resp := struct {
+		Job     apiJob      `json:"job"`
+		Samples []apiSample `json:"samples"`
+	}{
+		Job:     newAPIJob(s.Id, id, j),
+		Samples: []apiSample{},
+	}
+	for _, smp := range j.Samples {
+		resp.Samples = append(resp.Samples, newAPISample(smp))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func queryInt(req *http.Request, name string, def int64) (int64, error) {
+	v := req.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("bad %s %q", name, v)
+	}
+	return i, nil
+}
+
+func logType(req *http.Request) pb.LogType {
+	return pb.LogType(pb.LogType_value[strings.ToUpper(req.URL.Query().Get("type"))])
+}
+
+// logPage serves a page of the output written so far as JSON.
+func logPage(w http.ResponseWriter, req *http.Request, s *internal.Worker, id int64) {
+	offset, err := queryInt(req, "offset", 0)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := queryInt(req, "limit", defaultPageSize)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	if limit == 0 || limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	// Ask for an extra line to find out if there are more.
+	stream, err := s.Client.Logs(userContext(req), &pb.LogsRequest{
+		JobId:  id,
+		Type:   logType(req),
+		Offset: offset,
+		Limit:  limit + 1,
+		NoWait: true,
+	})
+	if err != nil {
+		rpcError(w, err)
+		return
+	}
+
+	page := struct {
+		Lines []apiLine `json:"lines"`
+		Next  int64     `json:"next"`
+		More  bool      `json:"more"`
+	}{Lines: []apiLine{}, Next: offset}
+	for {
+		r, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rpcError(w, err)
+			return
+		}
+		if int64(len(page.Lines)) == limit {
+			page.More = true
+			break
+		}
+		page.Lines = append(page.Lines, newAPILine(r))
+		page.Next = r.Line + 1
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// logStream follows the job's output from the given offset as server-sent events, ending with the job's final
+// state.
+func logStream(w http.ResponseWriter, req *http.Request, s *internal.Worker, id int64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	offset, err := queryInt(req, "offset", 0)
+	if err != nil {
+		handleError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := req.Context()
+	stream, err := s.Client.Logs(userContext(req), &pb.LogsRequest{JobId: id, Type: logType(req), Offset: offset})
+	if err != nil {
+		handleError(w, httpStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	send := func(name string, v interface{}) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, b); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	for {
+		r, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if c := grpcstatus.Code(err); c == codes.Unauthenticated || c == codes.PermissionDenied {
+			// Refusals come before any line is sent, so can still be reported with an error status.
+			handleError(w, httpStatus(err), err)
+			return
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				glog.Warningf("failed to follow logs for job %d on %s: %s", id, s.Id, err)
+			}
+			return
+		}
+		if err := send("line", newAPILine(r)); err != nil {
+			return
+		}
+	}
+
+	j, err := s.Client.Job(context.Background(), &pb.JobRequest{Id: id})
+	if err != nil {
+		glog.Warningf("failed to get job %d on %s: %s", id, s.Id, err)
+		return
+	}
+	send("end", newAPIJob(s.Id, id, j))
+}
+
+// logDownload serves the output written so far as a text file.
+func logDownload(w http.ResponseWriter, req *http.Request, s *internal.Worker, id int64) {
+	stream, err := s.Client.Logs(userContext(req), &pb.LogsRequest{JobId: id, Type: logType(req), NoWait: true})
+	if err != nil {
+		handleError(w, httpStatus(err), err)
+		return
+	}
+
+	// The first line is read before writing anything so that a refusal, such as to a user who hasn't signed in,
+	// can still be reported with an error status.
+	r, err := stream.Recv()
+	if err != nil && err != io.EOF {
+		handleError(w, httpStatus(err), err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"job-%d.log\"", id))
+	for ; err != io.EOF; r, err = stream.Recv() {
+		if err != nil {
+			// Headers have been sent, so all that can be done is to note the truncation.
+			fmt.Fprintf(w, "\n[E] log truncated: %s\n", err)
+			return
+		}
+		if _, err := io.WriteString(w, r.Chunk); err != nil {
+			return
+		}
+	}
+}
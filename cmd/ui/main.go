@@ -7,17 +7,17 @@ import (
 	"fmt"
 	"html"
 	"html/template"
-	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
 	"sync"
 	"time"
 
 	"github.com/dominichamon/sprinkle/internal"
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/net/context"
 
 	pb "github.com/dominichamon/sprinkle/api/sprinkle"
@@ -28,16 +28,31 @@ var (
 	poll       = flag.Duration("poll", 1*time.Minute, "The time to wait between discovery attempts")
 	statusPoll = flag.Duration("status_poll", 10*time.Second, "The time to wait between status updates")
 
-	addr  = flag.String("addr", "239.192.0.1:9999", "The multicast address to use for discovery")
-	dport = flag.Int("dport", 9997, "The port on which to listen for discovery")
+	addr      = flag.String("addr", "239.192.0.1:9999", "The multicast address to use for discovery. Multicast discovery is disabled if empty")
+	dport     = flag.Int("dport", 0, "The port on which to listen for discovery acks. Defaults to an ephemeral port")
+	dtimeout  = flag.Duration("discovery_timeout", internal.DefaultDiscoveryTimeout, "How long to wait for workers to respond to discovery")
+	discovery = flag.String("discovery", internal.MechanismMulticast, "Comma-separated discovery mechanisms to use: multicast, mdns")
+	iface     = flag.String("iface", "", "The interface to send discovery pings from. Defaults to the system's choice if unset")
+	cluster   = flag.String("cluster", internal.DefaultCluster, "The cluster whose workers to discover")
+	keyFile   = flag.String("discovery_key", "", "Path to a shared secret used to sign pings. If set, unsigned acks are ignored")
+	seeds     = flag.String("seeds", "", "Comma-separated host:port addresses of workers to ask for peers, in addition to multicast")
+	seedsFile = flag.String("seeds_file", "", "Path to a file of seed addresses, one per line")
+
+	tlsCert = flag.String("tls_cert", "", "Path to the PEM client certificate to present to workers that require one")
+	tlsKey  = flag.String("tls_key", "", "Path to the PEM private key for tls_cert")
+	tlsCA   = flag.String("tls_ca", "", "Path to a PEM CA certificate to verify workers against. Connections are plaintext unless a TLS flag is set")
+
+	token     = flag.String("token", "", "The bearer token to present to workers. Defaults to $"+internal.TokenEnv+", then the contents of token_file")
+	tokenFile = flag.String("token_file", internal.DefaultTokenFile(), "Path to a file containing the bearer token to present to workers")
 
 	worker workerMap
 	status statusMap
 	jobs   jobsMap
 
-	//go:embed index.html
+	//go:embed index.html job.html timeline.html style.css actions.js charts.js
 	embedFS   embed.FS
 	indexTmpl *template.Template
+	jobTmpl   *template.Template
 
 	funcMap = template.FuncMap{
 		"toGB": func(bytes uint64) string {
@@ -49,6 +64,9 @@ var (
 			}
 			return time.Unix(end, 0).Sub(time.Unix(start, 0))
 		},
+		"state":      stateName,
+		"rerunnable": rerunnable,
+		"latest":     latestSample,
 		"hasJobs": func(jobs map[string]map[int64]*pb.JobResponse) bool {
 			for _, jr := range jobs {
 				if len(jr) > 0 {
@@ -87,11 +105,39 @@ type statusMap struct {
 type jobsMap struct {
 	sync.RWMutex
 	jobs map[string]map[int64]*pb.JobResponse
+	// since holds, for each worker, the latest time in its jobs as of the last listing. Only jobs that were
+	// running at or after then can have changed, so only they need listing next time. Workers without one
+	// are listed in full, which also drops jobs they no longer have.
+	since map[string]int64
+}
+
+// update merges the jobs from a listing of a worker's jobs since the given time, replacing them if it was a
+// full listing.
+func (m *jobsMap) update(worker string, since int64, jrs []*pb.JobResponse) {
+	m.Lock()
+	defer m.Unlock()
+
+	if since == 0 || m.jobs[worker] == nil {
+		m.jobs[worker] = make(map[int64]*pb.JobResponse)
+	}
+	latest := since
+	for _, j := range jrs {
+		m.jobs[worker][j.Id] = j
+		if j.StartTime > latest {
+			latest = j.StartTime
+		}
+		if j.EndTime > latest {
+			latest = j.EndTime
+		}
+	}
+	m.since[worker] = latest
 }
 
 func init() {
 	indexTmpl = template.Must(
 		template.New("index.html").Funcs(funcMap).ParseFS(embedFS, "index.html"))
+	jobTmpl = template.Must(
+		template.New("job.html").Funcs(funcMap).ParseFS(embedFS, "job.html"))
 
 	worker.Lock()
 	worker.worker = make(map[string]*internal.Worker)
@@ -103,6 +149,7 @@ func init() {
 
 	jobs.Lock()
 	jobs.jobs = make(map[string]map[int64]*pb.JobResponse)
+	jobs.since = make(map[string]int64)
 	jobs.Unlock()
 }
 
@@ -113,6 +160,8 @@ func handleError(w http.ResponseWriter, code int, err error) {
 }
 
 func index(w http.ResponseWriter, req *http.Request) {
+	csrf := csrfToken(w, req)
+
 	status.RLock()
 	defer status.RUnlock()
 
@@ -120,10 +169,12 @@ func index(w http.ResponseWriter, req *http.Request) {
 	defer jobs.RUnlock()
 
 	data := struct {
+		CSRF         string
 		Status       map[string]*pb.StatusResponse
 		ActiveJobs   map[string]map[int64]*pb.JobResponse
 		InactiveJobs map[string]map[int64]*pb.JobResponse
 	}{
+		csrf,
 		status.status,
 		make(map[string]map[int64]*pb.JobResponse),
 		make(map[string]map[int64]*pb.JobResponse),
@@ -148,6 +199,19 @@ func index(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// static serves an embedded file.
+func static(name, contentType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := embedFS.ReadFile(name)
+		if err != nil {
+			handleError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(b)
+	}
+}
+
 func favIcon(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "image/x-icon")
 	w.Header().Set("Cache-Control", "public, max-age=7776000")
@@ -175,24 +239,18 @@ func logo(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, path.Join(pwd, "logo.png"))
 }
 
-func handleDiscoveryAcks(ctx context.Context, addrs <-chan string) {
+func handleDiscovered(ctx context.Context, workers []internal.WorkerInfo) {
 	worker.clear()
-	for saddr := range addrs {
-		glog.Infof("Discovered worker at %s", saddr)
 
-		host, port, err := net.SplitHostPort(saddr)
-		if err != nil {
-			glog.Error(err)
-			continue
-		}
+	// Resynchronize all jobs with a full listing on the next update.
+	jobs.Lock()
+	jobs.since = make(map[string]int64)
+	jobs.Unlock()
 
-		p, err := strconv.ParseInt(port, 10, 32)
-		if err != nil {
-			glog.Error(err)
-			continue
-		}
+	for _, w := range workers {
+		glog.Infof("Discovered worker at %s via %s", w.Addr, w.Source)
 
-		s, err := internal.NewWorker(host, int(p))
+		s, err := internal.DialWorker(w.Addr)
 		if err != nil {
 			glog.Errorf("Failed to create new worker: %s", err)
 			continue
@@ -200,6 +258,7 @@ func handleDiscoveryAcks(ctx context.Context, addrs <-chan string) {
 
 		glog.Infof("Connected to %+v", s)
 		worker.add(s)
+		watchWorker(ctx, s.Id)
 
 		stat, err := s.Client.Status(ctx, &pb.StatusRequest{})
 		if err != nil {
@@ -245,44 +304,112 @@ func updateWorkers(ctx context.Context) {
 			status.status[s.Id] = stat
 			status.Unlock()
 
-			jobsResp, err := s.Client.Jobs(ctx, &pb.JobsRequest{})
+			jobs.RLock()
+			since := jobs.since[s.Id]
+			jobs.RUnlock()
+			jrs, err := s.ListJobs(ctx, &pb.ListJobsRequest{Since: since})
 			if err != nil {
-				glog.Warningf("Failed to get jobs for %+v: %s", s, err)
+				glog.Warningf("Failed to list jobs for %+v: %s", s, err)
 				continue
 			}
-			glog.Infof("Jobs for %s: %+v", s.Id, jobsResp)
-			jrs := make(map[int64]*pb.JobResponse)
-			for _, id := range jobsResp.Id {
-				j, err := s.Client.Job(ctx, &pb.JobRequest{Id: id})
-				if err != nil {
-					glog.Warningf("Failed to get job for %+v, %d: %s", s, id, err)
-					continue
-				}
-				jrs[id] = j
-			}
-			jobs.Lock()
-			jobs.jobs[s.Id] = jrs
-			jobs.Unlock()
+			glog.Infof("Jobs for %s since %d: %+v", s.Id, since, jrs)
+			jobs.update(s.Id, since, jrs)
 		}
 
+		now := time.Now()
+		status.RLock()
+		jobs.RLock()
+		samples := takeSamples(now)
+		jobs.RUnlock()
+		status.RUnlock()
+		history.record(now, samples)
+
+		events.publish()
+
 		time.Sleep(*statusPoll)
 	}
 }
 
+// discoverer returns the discovery mechanisms configured by flags.
+func discoverer() (internal.Discoverer, error) {
+	key, err := internal.LoadKey(*keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load discovery key: %s", err)
+	}
+
+	mechanisms, err := internal.ParseMechanisms(*discovery)
+	if err != nil {
+		return nil, err
+	}
+
+	ss, err := internal.ParseSeeds(*seeds, *seedsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse seeds: %s", err)
+	}
+
+	var ds []internal.Discoverer
+	if mechanisms[internal.MechanismMulticast] && *addr != "" {
+		ds = append(ds, &internal.Pinger{
+			Transport: &internal.Multicast{Addr: *addr, Port: *dport, Iface: *iface},
+			Codec:     internal.NewCodec(*cluster, key),
+		})
+	}
+	if mechanisms[internal.MechanismMDNS] {
+		ds = append(ds, &internal.MDNS{Cluster: *cluster, Iface: *iface})
+	}
+	if len(ss) != 0 {
+		ds = append(ds, &internal.Seeds{Addrs: ss, Cluster: *cluster})
+	}
+	return internal.Merge(ds...), nil
+}
+
+// configureTLS sets up TLS for connections to workers if any of the TLS flags are set.
+func configureTLS() error {
+	files := internal.TLSFiles{Cert: *tlsCert, Key: *tlsKey, CA: *tlsCA}
+	if !files.Enabled() {
+		return nil
+	}
+
+	config, err := files.ClientConfig()
+	if err != nil {
+		return err
+	}
+	internal.SetClientTLS(config)
+	return nil
+}
+
 func main() {
 	flag.Parse()
 
 	ctx := context.Background()
 
+	if err := configureTLS(); err != nil {
+		glog.Exit("failed to configure TLS: ", err)
+	}
+
+	t, err := internal.LoadToken(*token, *tokenFile)
+	if err != nil {
+		glog.Exit("failed to load token: ", err)
+	}
+	internal.SetToken(t)
+
+	if err := setupHistory(); err != nil {
+		glog.Exit("failed to set up history: ", err)
+	}
+
+	d, err := discoverer()
+	if err != nil {
+		glog.Exit(err)
+	}
+
 	go func() {
 		for {
-			addrs := make(chan string)
-			err := internal.Ping(*addr, *dport, addrs)
+			workers, err := d.Discover(ctx, internal.DiscoverOptions{Timeout: *dtimeout})
 			if err != nil {
 				glog.Error(err)
 				goto sleep
 			}
-			handleDiscoveryAcks(ctx, addrs)
+			handleDiscovered(ctx, workers)
 		sleep:
 			time.Sleep(*poll)
 		}
@@ -292,6 +419,19 @@ func main() {
 	http.HandleFunc("/", index)
 	http.HandleFunc("/favicon.ico", favIcon)
 	http.HandleFunc("/logo.png", logo)
+	http.HandleFunc("/style.css", static("style.css", "text/css; charset=utf-8"))
+	http.HandleFunc("/actions.js", static("actions.js", "text/javascript; charset=utf-8"))
+	http.HandleFunc("/charts.js", static("charts.js", "text/javascript; charset=utf-8"))
+	http.HandleFunc("/timeline", static("timeline.html", "text/html; charset=utf-8"))
+	http.HandleFunc("/jobs/", jobPage)
+	http.HandleFunc("/events", eventStream)
+	http.HandleFunc(apiPrefix, api)
+	http.HandleFunc("/api/", api)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(clusterCollector{})
+	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
 	glog.Infof("listening on port %d", *port)
 	glog.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+var (
+	clusterWorkersDesc  = prometheus.NewDesc("sprinkle_cluster_workers", "Workers with a known status.", nil, nil)
+	clusterTotalRAMDesc = prometheus.NewDesc("sprinkle_cluster_ram_total_bytes", "Total RAM across workers.", nil, nil)
+	clusterFreeRAMDesc  = prometheus.NewDesc("sprinkle_cluster_ram_free_bytes", "Available RAM across workers.", nil, nil)
+	clusterJobsDesc     = prometheus.NewDesc("sprinkle_cluster_jobs", "Jobs across workers, by state.", []string{"state"}, nil)
+	workerTotalRAMDesc  = prometheus.NewDesc("sprinkle_worker_ram_total_bytes", "Total RAM of each worker.", []string{"worker"}, nil)
+	workerFreeRAMDesc   = prometheus.NewDesc("sprinkle_worker_ram_free_bytes", "Available RAM of each worker.", []string{"worker"}, nil)
+	workerLoadDesc      = prometheus.NewDesc("sprinkle_worker_load5", "Five minute load average of each worker.", []string{"worker"}, nil)
+	workerJobsDesc      = prometheus.NewDesc("sprinkle_worker_jobs", "Jobs on each worker, by state.", []string{"worker", "state"}, nil)
+)
+
+// clusterCollector exports the latest status and jobs gathered from workers.
+type clusterCollector struct{}
+
+func (clusterCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		clusterWorkersDesc, clusterTotalRAMDesc, clusterFreeRAMDesc, clusterJobsDesc,
+		workerTotalRAMDesc, workerFreeRAMDesc, workerLoadDesc, workerJobsDesc,
+	} {
+		ch <- d
+	}
+}
+
+func (clusterCollector) Collect(ch chan<- prometheus.Metric) {
+	status.RLock()
+	var workers int
+	var total, free uint64
+	for id, s := range status.status {
+		if s == nil {
+			continue
+		}
+		workers++
+		total += s.TotalRam
+		free += s.FreeRam
+		ch <- prometheus.MustNewConstMetric(workerTotalRAMDesc, prometheus.GaugeValue, float64(s.TotalRam), id)
+		ch <- prometheus.MustNewConstMetric(workerFreeRAMDesc, prometheus.GaugeValue, float64(s.FreeRam), id)
+		ch <- prometheus.MustNewConstMetric(workerLoadDesc, prometheus.GaugeValue, s.Load, id)
+	}
+	status.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(clusterWorkersDesc, prometheus.GaugeValue, float64(workers))
+	ch <- prometheus.MustNewConstMetric(clusterTotalRAMDesc, prometheus.GaugeValue, float64(total))
+	ch <- prometheus.MustNewConstMetric(clusterFreeRAMDesc, prometheus.GaugeValue, float64(free))
+
+	jobs.RLock()
+	cluster := make(map[pb.JobResponse_State]int)
+	for id, jrs := range jobs.jobs {
+		counts := make(map[pb.JobResponse_State]int)
+		for _, j := range jrs {
+			counts[j.State]++
+			cluster[j.State]++
+		}
+		for state, n := range counts {
+			ch <- prometheus.MustNewConstMetric(workerJobsDesc, prometheus.GaugeValue, float64(n), id, stateName(state))
+		}
+	}
+	jobs.RUnlock()
+
+	for state, n := range cluster {
+		ch <- prometheus.MustNewConstMetric(clusterJobsDesc, prometheus.GaugeValue, float64(n), stateName(state))
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dominichamon/sprinkle/internal"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+const (
+	csrfCookie = "sprinkle_csrf"
+	csrfHeader = "X-CSRF-Token"
+	// tokenCookie keeps the token of the user signed in to the UI.
+	tokenCookie = "sprinkle_token"
+)
+
+const (
+	// submissionTTL is how long a submission is remembered for re-running.
+	submissionTTL = 24 * time.Hour
+	// maxSubmissions is the most submissions remembered, beyond which the oldest are forgotten.
+	maxSubmissions = 1000
+)
+
+var submitted submissionMap
+
+// submission is a job submitted through the UI, remembered so that it can be re-run.
+type submission struct {
+	req         *pb.RunRequest
+	constraints map[string]string
+	// submitter identifies the user that submitted the job, who alone may re-run it with its environment.
+	submitter string
+	at        time.Time
+}
+
+type submissionMap struct {
+	sync.RWMutex
+	submissions map[string]submission
+}
+
+func init() {
+	submitted.Lock()
+	submitted.submissions = make(map[string]submission)
+	submitted.Unlock()
+}
+
+func submissionKey(worker string, id int64) string {
+	return fmt.Sprintf("%s/%d", worker, id)
+}
+
+// submitterID identifies the user presenting token without keeping the token itself. It is empty for anonymous
+// users.
+func submitterID(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *submissionMap) get(worker string, id int64) (submission, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	s, ok := m.submissions[submissionKey(worker, id)]
+	return s, ok
+}
+
+// add remembers a submission, forgetting those that have expired and, if there are still too many, the oldest.
+func (m *submissionMap) add(worker string, id int64, s submission) {
+	m.Lock()
+	defer m.Unlock()
+	var oldest string
+	for k, old := range m.submissions {
+		if s.at.Sub(old.at) > submissionTTL {
+			delete(m.submissions, k)
+		} else if oldest == "" || old.at.Before(m.submissions[oldest].at) {
+			oldest = k
+		}
+	}
+	if len(m.submissions) >= maxSubmissions {
+		delete(m.submissions, oldest)
+	}
+	m.submissions[submissionKey(worker, id)] = s
+}
+
+// resubmission returns how submitter may run a job again: as they submitted it through the UI, or as the
+// worker echoed it if that is complete. Submissions keep the values of environment variables, which may be
+// secrets, so only their submitter may re-run them. Echoes omit the values, so jobs that set any can only be
+// re-run by the user that submitted them here.
+func resubmission(worker string, id int64, j *pb.JobResponse, submitter string) (submission, bool) {
+	if s, ok := submitted.get(worker, id); ok && s.submitter == submitter {
+		return s, true
+	}
+	if j.GetRequest() == nil || len(j.EnvKeys) != 0 {
+		return submission{}, false
+	}
+	return submission{req: j.Request}, true
+}
+
+// rerunnable reports whether a job can be run again by someone: the user that submitted it through the UI, or
+// anyone if the worker's echo of it is complete.
+func rerunnable(worker string, id int64, j *pb.JobResponse) bool {
+	if _, ok := submitted.get(worker, id); ok {
+		return true
+	}
+	return j.GetRequest() != nil && len(j.EnvKeys) == 0
+}
+
+// csrfToken returns the browser's CSRF token, setting a new one if it has none.
+func csrfToken(w http.ResponseWriter, req *http.Request) string {
+	if c, err := req.Cookie(csrfCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		glog.Errorf("failed to generate CSRF token: %s", err)
+		return ""
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// checkCSRF verifies that a request that changes state came from one of the UI's own pages: it must carry the
+// token from the browser's cookie in a header, which other sites cannot read, and any Origin must be this host.
+func checkCSRF(req *http.Request) error {
+	if origin := req.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != req.Host {
+			return fmt.Errorf("cross-origin request from %q", origin)
+		}
+	}
+	c, err := req.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return errors.New("missing CSRF cookie")
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Value), []byte(req.Header.Get(csrfHeader))) != 1 {
+		return errors.New("invalid CSRF token")
+	}
+	return nil
+}
+
+// userToken returns the token the browser presents for its user: from an Authorization: Bearer header, or from
+// the cookie set by signing in to the UI.
+func userToken(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if c, err := req.Cookie(tokenCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// userContext returns a context for RPCs made on behalf of the browser. It presents the user's own token, never
+// the UI's, so workers that require authentication reject the RPCs of users that have not signed in.
+func userContext(req *http.Request) context.Context {
+	if token := userToken(req); token != "" {
+		return internal.WithToken(req.Context(), token)
+	}
+	return internal.WithoutToken(req.Context())
+}
+
+// apiLogin signs the browser in by keeping the given token in a cookie, or signs it out if the token is empty.
+func apiLogin(w http.ResponseWriter, req *http.Request) {
+	var login struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&login); err != nil {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("bad login: %s", err))
+		return
+	}
+	c := &http.Cookie{
+		Name:     tokenCookie,
+		Value:    strings.TrimSpace(login.Token),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	}
+	if c.Value == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+	writeJSON(w, http.StatusOK, map[string]bool{"signed_in": c.Value != ""})
+}
+
+// httpStatus returns the HTTP status closest to that of a failed RPC.
+func httpStatus(err error) int {
+	switch grpcstatus.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.FailedPrecondition:
+		return http.StatusConflict
+	}
+	return http.StatusBadGateway
+}
+
+// rpcError reports a failed RPC with the closest HTTP status.
+func rpcError(w http.ResponseWriter, err error) {
+	apiError(w, httpStatus(err), errors.New(grpcstatus.Convert(err).Message()))
+}
+
+// refreshJob fetches the latest state of a job and publishes it to browsers without waiting for the next poll.
+func refreshJob(ctx context.Context, s *internal.Worker, id int64) {
+	j, err := s.Client.Job(ctx, &pb.JobRequest{Id: id})
+	if err != nil {
+		glog.Warningf("failed to get job %d on %s: %s", id, s.Id, err)
+		return
+	}
+	jobs.Lock()
+	if jobs.jobs[s.Id] == nil {
+		jobs.jobs[s.Id] = make(map[int64]*pb.JobResponse)
+	}
+	jobs.jobs[s.Id][id] = j
+	jobs.Unlock()
+	events.publish()
+}
+
+// submit runs a job on the best worker that accepts it, using the same scheduling as the run command.
+func submit(ctx context.Context, req *pb.RunRequest, constraints map[string]string, submitter string) (string, int64, error) {
+	status.RLock()
+	var cs []internal.Candidate
+	for id, s := range status.status {
+		cs = append(cs, internal.Candidate{Addr: id, Status: s})
+	}
+	status.RUnlock()
+
+	fit := internal.Schedule(cs, req.Ram, constraints)
+	if len(fit) == 0 {
+		return "", 0, grpcstatus.Error(codes.FailedPrecondition, "no worker can run the job")
+	}
+
+	var err error
+	for _, c := range fit {
+		s, ok := lookupWorker(c.Addr)
+		if !ok {
+			continue
+		}
+		var resp *pb.RunResponse
+		resp, err = s.Client.Run(ctx, req)
+		if err != nil {
+			glog.Warningf("failed to run job on %s: %s", s.Id, err)
+			continue
+		}
+
+		submitted.add(s.Id, resp.JobId, submission{
+			req:         req,
+			constraints: constraints,
+			submitter:   submitter,
+			at:          time.Now(),
+		})
+
+		refreshJob(ctx, s, resp.JobId)
+		return s.Id, resp.JobId, nil
+	}
+	if err == nil {
+		err = grpcstatus.Error(codes.Unavailable, "no worker can run the job")
+	}
+	return "", 0, err
+}
+
+// apiSubmission is a job to run, as submitted to the JSON API.
+type apiSubmission struct {
+	Cmd         string            `json:"cmd"`
+	RAM         uint64            `json:"ram"`
+	Env         map[string]string `json:"env"`
+	Labels      map[string]string `json:"labels"`
+	Constraints map[string]string `json:"constraints"`
+	// Timeout is a duration such as "90s". Unlimited if empty.
+	Timeout     string            `json:"timeout"`
+	Name        string            `json:"name"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+func writeSubmitted(w http.ResponseWriter, worker string, id int64) {
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"worker": worker, "id": id})
+}
+
+func apiSubmit(w http.ResponseWriter, req *http.Request) {
+	var sub apiSubmission
+	if err := json.NewDecoder(req.Body).Decode(&sub); err != nil {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("bad submission: %s", err))
+		return
+	}
+	if strings.TrimSpace(sub.Cmd) == "" {
+		apiError(w, http.StatusBadRequest, errors.New("a command is required"))
+		return
+	}
+	var timeout time.Duration
+	if sub.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(sub.Timeout); err != nil || timeout < 0 {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("bad timeout %q", sub.Timeout))
+			return
+		}
+	}
+
+	worker, id, err := submit(userContext(req), &pb.RunRequest{
+		Cmd:            sub.Cmd,
+		Ram:            sub.RAM,
+		Env:            sub.Env,
+		Labels:         sub.Labels,
+		TimeoutSeconds: int64(timeout.Seconds()),
+		Name:           sub.Name,
+		Annotations:    sub.Annotations,
+	}, sub.Constraints, submitterID(userToken(req)))
+	if err != nil {
+		rpcError(w, err)
+		return
+	}
+	writeSubmitted(w, worker, id)
+}
+
+func apiCancel(w http.ResponseWriter, req *http.Request, s *internal.Worker, id int64) {
+	ctx := userContext(req)
+	if _, err := s.Client.Cancel(ctx, &pb.CancelRequest{JobId: id}); err != nil {
+		rpcError(w, err)
+		return
+	}
+	refreshJob(ctx, s, id)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"worker": s.Id, "id": id})
+}
+
+func apiRerun(w http.ResponseWriter, req *http.Request, s *internal.Worker, id int64) {
+	jobs.RLock()
+	j := jobs.jobs[s.Id][id]
+	jobs.RUnlock()
+	submitter := submitterID(userToken(req))
+	sub, ok := resubmission(s.Id, id, j, submitter)
+	if !ok {
+		apiError(w, http.StatusNotFound, fmt.Errorf("job %d on %s can't be re-run: its request is unknown, or set environment variables and was submitted by someone else", id, s.Id))
+		return
+	}
+	worker, newID, err := submit(userContext(req), proto.Clone(sub.req).(*pb.RunRequest), sub.constraints, submitter)
+	if err != nil {
+		rpcError(w, err)
+		return
+	}
+	writeSubmitted(w, worker, newID)
+}
+
+// apiJobAction routes a POST to a job given a path of the form worker/id/action.
+func apiJobAction(w http.ResponseWriter, req *http.Request, p string) {
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		apiError(w, http.StatusNotFound, fmt.Errorf("unknown endpoint %q", req.URL.Path))
+		return
+	}
+	var action func(http.ResponseWriter, *http.Request, *internal.Worker, int64)
+	switch p[i+1:] {
+	case "cancel":
+		action = apiCancel
+	case "rerun":
+		action = apiRerun
+	default:
+		apiError(w, http.StatusNotFound, fmt.Errorf("unknown action %q", p[i+1:]))
+		return
+	}
+
+	wid, id, err := parseJobPath(p[:i])
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	s, ok := lookupWorker(wid)
+	if !ok {
+		apiError(w, http.StatusNotFound, fmt.Errorf("worker %q not found", wid))
+		return
+	}
+	action(w, req, s, id)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+var watching watchSet
+
+// watchSet holds the workers being watched.
+type watchSet struct {
+	sync.Mutex
+	ids map[string]bool
+}
+
+func init() {
+	watching.Lock()
+	watching.ids = make(map[string]bool)
+	watching.Unlock()
+}
+
+// watchWorker starts applying the worker's events as they happen, unless they already are. Polling still
+// catches anything missed while not watching.
+func watchWorker(ctx context.Context, id string) {
+	watching.Lock()
+	defer watching.Unlock()
+	if watching.ids[id] {
+		return
+	}
+	watching.ids[id] = true
+
+	go func() {
+		defer func() {
+			watching.Lock()
+			delete(watching.ids, id)
+			watching.Unlock()
+		}()
+		watchEvents(ctx, id)
+	}()
+}
+
+// watchEvents applies events from the worker until it is no longer discovered, resuming after the last event
+// received whenever the stream breaks.
+func watchEvents(ctx context.Context, id string) {
+	var token string
+	for {
+		s, ok := lookupWorker(id)
+		if !ok {
+			return
+		}
+
+		stream, err := s.Client.Watch(ctx, &pb.WatchRequest{ResumeToken: token})
+		for err == nil {
+			var e *pb.WatchEvent
+			if e, err = stream.Recv(); err == nil {
+				token = e.Token
+				applyEvent(id, e)
+			}
+		}
+
+		switch grpcstatus.Code(err) {
+		case codes.Unimplemented:
+			glog.Infof("%s can't be watched; polling only", id)
+			return
+		case codes.OutOfRange:
+			// Events were missed, so relist the worker's jobs in full and watch afresh.
+			glog.Infof("resynchronizing %s: %s", id, err)
+			token = ""
+			jobs.Lock()
+			delete(jobs.since, id)
+			jobs.Unlock()
+			continue
+		}
+		glog.Warningf("stopped watching %s: %s", id, err)
+		time.Sleep(*statusPoll)
+	}
+}
+
+// applyEvent updates what is known of the worker from one of its events, and publishes the change to browsers.
+func applyEvent(id string, e *pb.WatchEvent) {
+	glog.Infof("Event from %s: %+v", id, e)
+	switch {
+	case e.Job != nil:
+		jobs.Lock()
+		if jobs.jobs[id] == nil {
+			jobs.jobs[id] = make(map[int64]*pb.JobResponse)
+		}
+		jobs.jobs[id][e.Job.Id] = e.Job
+		jobs.Unlock()
+	case e.Status != nil:
+		status.Lock()
+		status.status[id] = e.Status
+		status.Unlock()
+	default:
+		return
+	}
+	events.publish()
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+var (
+	audit *auditLog
+
+	auditPath    = flag.String("audit_log", "", "Path to append a JSON lines audit log of RPCs and jobs to. Auditing is disabled if empty")
+	auditMaxSize = flag.Int64("audit_max_size", 100<<20, "The size in bytes at which the audit log is rotated")
+	auditKeep    = flag.Int("audit_keep", 5, "The number of rotated audit logs to keep")
+)
+
+// auditUsage is the resource usage of a completed job.
+type auditUsage struct {
+	UserSec   float64 `json:"user_sec"`
+	SystemSec float64 `json:"system_sec"`
+	MaxRSS    int64   `json:"max_rss"`
+}
+
+// auditEvent is a single line of the audit log.
+type auditEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Caller string    `json:"caller,omitempty"`
+	Peer   string    `json:"peer,omitempty"`
+
+	// RPC events.
+	Method   string          `json:"method,omitempty"`
+	Code     string          `json:"code,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Request  json.RawMessage `json:"request,omitempty"`
+	Duration float64         `json:"duration_sec,omitempty"`
+
+	// Job events.
+	JobID    int64       `json:"job_id,omitempty"`
+	Admitted *bool       `json:"admitted,omitempty"`
+	Reason   string      `json:"reason,omitempty"`
+	Dir      string      `json:"dir,omitempty"`
+	ExitCode *int        `json:"exit_code,omitempty"`
+	Usage    *auditUsage `json:"usage,omitempty"`
+}
+
+// auditLog appends events to a file, rotating it once it grows beyond a maximum size.
+type auditLog struct {
+	sync.Mutex
+	path string
+	f    *os.File
+	size int64
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{path: path}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f = f
+	a.size = fi.Size()
+	return nil
+}
+
+// rotate renames the log to path.1, shifting older logs along and dropping the oldest. The log is only swapped
+// for a new one once that has been opened, so that if rotation fails, events are still appended to the old one.
+func (a *auditLog) rotate() error {
+	for i := *auditKeep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if *auditKeep > 0 {
+		if err := os.Rename(a.path, a.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.path); err != nil {
+		return err
+	}
+	old := a.f
+	if err := a.open(); err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+func (a *auditLog) record(e *auditEvent) {
+	if a == nil {
+		return
+	}
+	e.Time = time.Now()
+	b, err := json.Marshal(e)
+	if err != nil {
+		glog.Errorf("failed to encode audit event: %s", err)
+		return
+	}
+	b = append(b, '\n')
+
+	a.Lock()
+	defer a.Unlock()
+	if a.size > 0 && a.size+int64(len(b)) > *auditMaxSize {
+		if err := a.rotate(); err != nil {
+			glog.Errorf("failed to rotate audit log: %s", err)
+		}
+	}
+	n, err := a.f.Write(b)
+	a.size += int64(n)
+	if err != nil {
+		glog.Errorf("failed to write audit event: %s", err)
+	}
+}
+
+// setupAudit opens the audit log, if any.
+func setupAudit() error {
+	if *auditPath == "" {
+		return nil
+	}
+	var err error
+	audit, err = openAuditLog(*auditPath)
+	return err
+}
+
+// auditCall is filled in by the authenticator so the audit interceptor, which runs first, learns the caller.
+type auditCall struct {
+	caller string
+}
+
+type auditKey struct{}
+
+func setAuditCaller(ctx context.Context, who string) {
+	if c, ok := ctx.Value(auditKey{}).(*auditCall); ok {
+		c.caller = who
+	}
+}
+
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// encodeRequest encodes a request for the log, leaving out the values of environment variables, which may be
+// secret.
+func encodeRequest(req interface{}) json.RawMessage {
+	m, ok := req.(proto.Message)
+	if !ok {
+		return nil
+	}
+	if r, ok := m.(*pb.RunRequest); ok && len(r.Env) != 0 {
+		r = proto.Clone(r).(*pb.RunRequest)
+		for k := range r.Env {
+			r.Env[k] = ""
+		}
+		m = r
+	}
+	b, err := protojson.Marshal(m)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func (a *auditLog) rpc(ctx context.Context, method string, req interface{}, start time.Time, call *auditCall, err error) {
+	e := &auditEvent{
+		Event:    "rpc",
+		Caller:   call.caller,
+		Peer:     peerAddr(ctx),
+		Method:   method,
+		Code:     status.Code(err).String(),
+		Request:  encodeRequest(req),
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	a.record(e)
+}
+
+func (a *auditLog) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if a == nil {
+		return handler(ctx, req)
+	}
+	start := time.Now()
+	call := &auditCall{}
+	resp, err := handler(context.WithValue(ctx, auditKey{}, call), req)
+	a.rpc(ctx, info.FullMethod, req, start, call, err)
+	return resp, err
+}
+
+// auditStream captures the first request received on a stream.
+type auditStream struct {
+	grpc.ServerStream
+	ctx context.Context
+	req interface{}
+}
+
+func (s *auditStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *auditStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil && s.req == nil {
+		s.req = m
+	}
+	return err
+}
+
+func (a *auditLog) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if a == nil {
+		return handler(srv, ss)
+	}
+	start := time.Now()
+	call := &auditCall{}
+	as := &auditStream{ServerStream: ss, ctx: context.WithValue(ss.Context(), auditKey{}, call)}
+	err := handler(srv, as)
+	a.rpc(ss.Context(), info.FullMethod, as.req, start, call, err)
+	return err
+}
+
+// admission records whether a job was admitted.
+func (a *auditLog) admission(ctx context.Context, req *pb.RunRequest, err error) {
+	admitted := err == nil
+	e := &auditEvent{
+		Event:    "admission",
+		Caller:   caller(ctx),
+		Peer:     peerAddr(ctx),
+		Request:  encodeRequest(req),
+		Admitted: &admitted,
+	}
+	if err != nil {
+		e.Reason = status.Convert(err).Message()
+	}
+	a.record(e)
+}
+
+// jobStarted records a job starting.
+func (a *auditLog) jobStarted(id int64, j job, req *pb.RunRequest) {
+	a.record(&auditEvent{
+		Event:   "job_started",
+		Caller:  j.owner,
+		JobID:   id,
+		Request: encodeRequest(req),
+		Dir:     j.dir,
+	})
+}
+
+// jobEvent records something happening to a running job, such as it being cancelled.
+func (a *auditLog) jobEvent(event string, id int64, who, reason string) {
+	a.record(&auditEvent{
+		Event:  event,
+		Caller: who,
+		JobID:  id,
+		Reason: reason,
+	})
+}
+
+// jobEnded records a job completing, with its exit status and resource usage.
+func (a *auditLog) jobEnded(id int64, j job) {
+	if a == nil {
+		return
+	}
+	e := &auditEvent{
+		Event:    "job_ended",
+		Caller:   j.owner,
+		JobID:    id,
+		Duration: j.end.Sub(j.start).Seconds(),
+	}
+	if ps := j.cmd.ProcessState; ps != nil {
+		code := ps.ExitCode()
+		e.ExitCode = &code
+		e.Reason = ps.String()
+		if su, ok := ps.SysUsage().(*syscall.Rusage); ok && su != nil {
+			e.Usage = &auditUsage{
+				UserSec:   float64(su.Utime.Sec) + float64(su.Utime.Usec)/1e6,
+				SystemSec: float64(su.Stime.Sec) + float64(su.Stime.Usec)/1e6,
+				MaxRSS:    int64(su.Maxrss),
+			}
+		}
+	}
+	a.record(e)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditRotateFailure(t *testing.T) {
+	defer func(size int64, keep int) { *auditMaxSize, *auditKeep = size, keep }(*auditMaxSize, *auditKeep)
+	*auditMaxSize, *auditKeep = 1, 1
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A non-empty directory in the way of the rotated log makes renaming fail.
+	if err := os.MkdirAll(filepath.Join(path+".1", "x"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	a.record(&auditEvent{Event: "one"})
+	a.record(&auditEvent{Event: "two"})
+	if got := readFile(t, path); !strings.Contains(got, `"one"`) || !strings.Contains(got, `"two"`) {
+		t.Errorf("after a failed rotation, log = %q, want both events", got)
+	}
+
+	// Once the way is clear, rotation resumes.
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	a.record(&auditEvent{Event: "three"})
+	if got := readFile(t, path+".1"); !strings.Contains(got, `"two"`) {
+		t.Errorf("rotated log = %q, want the earlier events", got)
+	}
+	if got := readFile(t, path); !strings.Contains(got, `"three"`) || strings.Contains(got, `"two"`) {
+		t.Errorf("log = %q, want only the latest event", got)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	auth authenticator
+
+	tokensFile = flag.String("tokens_file", "", "Path to a file of static bearer tokens, one \"token user\" pair per line")
+	jwtKey     = flag.String("jwt_key", "", "Path to a key to verify JWT bearer tokens with: a PEM public key, or an HMAC secret")
+	adminList  = flag.String("admins", "", "Comma-separated users that may view and cancel any job")
+	jobAccess  = flag.String("job_access", "owner", "Who may view the logs of and cancel a job: owner (and admins) or all")
+)
+
+// publicMethods may be called without authenticating as they are used for discovery and membership. Register is
+// not among them, as the workers it adds are dialled with callers' tokens.
+var publicMethods = map[string]bool{
+	"/sprinkle.Worker/Status":  true,
+	"/sprinkle.Worker/Peers":   true,
+	"/sprinkle.Worker/Members": true,
+}
+
+// authenticator identifies callers from bearer tokens or client certificates.
+type authenticator struct {
+	// tokens maps static tokens to users.
+	tokens map[string]string
+	// key verifies JWTs. JWTs are not accepted if nil.
+	key interface{}
+	// admins may view and cancel any job.
+	admins map[string]bool
+}
+
+// required reports whether callers must identify themselves.
+func (a *authenticator) required() bool {
+	return len(a.tokens) != 0 || a.key != nil
+}
+
+func loadTokens(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"token user\"", path, n)
+		}
+		tokens[fields[0]] = fields[1]
+	}
+	return tokens, s.Err()
+}
+
+// loadJWTKey reads a PEM encoded public key, or treats the file contents as an HMAC secret if it is not PEM.
+func loadJWTKey(path string) (interface{}, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		secret := []byte(strings.TrimSpace(string(b)))
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("JWT key %q is empty", path)
+		}
+		return secret, nil
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// setupAuth configures the authenticator from flags.
+func setupAuth() error {
+	if *jobAccess != "owner" && *jobAccess != "all" {
+		return fmt.Errorf("unknown job_access %q", *jobAccess)
+	}
+
+	if *tokensFile != "" {
+		tokens, err := loadTokens(*tokensFile)
+		if err != nil {
+			return fmt.Errorf("failed to load tokens: %s", err)
+		}
+		auth.tokens = tokens
+	}
+
+	if *jwtKey != "" {
+		key, err := loadJWTKey(*jwtKey)
+		if err != nil {
+			return fmt.Errorf("failed to load JWT key: %s", err)
+		}
+		auth.key = key
+	}
+
+	auth.admins = make(map[string]bool)
+	for _, a := range strings.Split(*adminList, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			auth.admins[a] = true
+		}
+	}
+	return nil
+}
+
+// verifyJWT returns the subject of a valid JWT signed with the configured key.
+func (a *authenticator) verifyJWT(token string) (string, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			if _, ok := a.key.([]byte); ok {
+				return a.key, nil
+			}
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA, *jwt.SigningMethodEd25519:
+			if _, ok := a.key.([]byte); !ok {
+				return a.key, nil
+			}
+		}
+		return nil, fmt.Errorf("unexpected signing method %q", t.Header["alg"])
+	})
+	if err != nil {
+		return "", err
+	}
+	if claims.Subject == "" {
+		return "", errors.New("token has no subject")
+	}
+	return claims.Subject, nil
+}
+
+// identify returns the caller's identity from its bearer token or, failing that, its verified client certificate.
+// An empty identity is returned for anonymous callers if authentication is not required, in which case bearer
+// tokens are ignored as there is nothing to check them against.
+func (a *authenticator) identify(ctx context.Context) (string, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok && a.required() {
+		for _, v := range md.Get("authorization") {
+			token := strings.TrimPrefix(v, "Bearer ")
+			if token == v {
+				continue
+			}
+			for t, user := range a.tokens {
+				if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+					return user, nil
+				}
+			}
+			if a.key != nil {
+				user, err := a.verifyJWT(token)
+				if err == nil {
+					return user, nil
+				}
+				glog.Warningf("rejecting JWT: %s", err)
+			}
+			return "", status.Error(codes.Unauthenticated, "invalid token")
+		}
+	}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) != 0 {
+			return info.State.VerifiedChains[0][0].Subject.CommonName, nil
+		}
+	}
+
+	if a.required() {
+		return "", status.Error(codes.Unauthenticated, "missing token")
+	}
+	return "", nil
+}
+
+type callerKey struct{}
+
+// caller returns the identity of the caller of the current RPC.
+func caller(ctx context.Context) string {
+	c, _ := ctx.Value(callerKey{}).(string)
+	return c
+}
+
+func (a *authenticator) authenticate(ctx context.Context, method string) (context.Context, error) {
+	if publicMethods[method] {
+		return ctx, nil
+	}
+	who, err := a.identify(ctx)
+	if err != nil {
+		return nil, err
+	}
+	setAuditCaller(ctx, who)
+	return context.WithValue(ctx, callerKey{}, who), nil
+}
+
+func (a *authenticator) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authStream overrides the context of a stream with one carrying the caller.
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authStream) Context() context.Context {
+	return s.ctx
+}
+
+func (a *authenticator) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.authenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authStream{ServerStream: ss, ctx: ctx})
+}
+
+// mayAccess reports whether the caller may view the logs of, or cancel, a job owned by owner.
+func (a *authenticator) mayAccess(ctx context.Context, owner string) bool {
+	if *jobAccess == "all" {
+		return true
+	}
+	who := caller(ctx)
+	return who == owner || a.admins[who]
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func withBearer(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+}
+
+func TestIdentify(t *testing.T) {
+	a := &authenticator{tokens: map[string]string{"secret": "alice"}}
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		want string
+		code codes.Code
+	}{
+		{"token", withBearer("secret"), "alice", codes.OK},
+		{"bad token", withBearer("guess"), "", codes.Unauthenticated},
+		{"anonymous", context.Background(), "", codes.Unauthenticated},
+	} {
+		got, err := a.identify(tc.ctx)
+		if status.Code(err) != tc.code || got != tc.want {
+			t.Errorf("%s: identify() = %q, %v; want %q, %s", tc.name, got, err, tc.want, tc.code)
+		}
+	}
+
+	// Without tokens or a key, any token is ignored.
+	open := &authenticator{}
+	for _, ctx := range []context.Context{withBearer("anything"), context.Background()} {
+		if got, err := open.identify(ctx); got != "" || err != nil {
+			t.Errorf("identify() without auth = %q, %v; want anonymous", got, err)
+		}
+	}
+}
+
+func TestAuthenticatePublicMethods(t *testing.T) {
+	a := &authenticator{tokens: map[string]string{"secret": "alice"}}
+	for method, public := range map[string]bool{
+		"/sprinkle.Worker/Status":   true,
+		"/sprinkle.Worker/Peers":    true,
+		"/sprinkle.Worker/Members":  true,
+		"/sprinkle.Worker/Register": false,
+		"/sprinkle.Worker/Run":      false,
+		"/sprinkle.Worker/Drain":    false,
+	} {
+		_, err := a.authenticate(context.Background(), method)
+		if public && err != nil {
+			t.Errorf("anonymous call to %s failed: %s", method, err)
+		}
+		if !public && status.Code(err) != codes.Unauthenticated {
+			t.Errorf("anonymous call to %s = %v, want Unauthenticated", method, err)
+		}
+	}
+}
+
+func TestMayAccess(t *testing.T) {
+	defer func(access string) { *jobAccess = access }(*jobAccess)
+	a := &authenticator{admins: map[string]bool{"root": true}}
+	as := func(who string) context.Context {
+		return context.WithValue(context.Background(), callerKey{}, who)
+	}
+
+	*jobAccess = "owner"
+	for who, want := range map[string]bool{"alice": true, "root": true, "bob": false, "": false} {
+		if got := a.mayAccess(as(who), "alice"); got != want {
+			t.Errorf("mayAccess(%q, alice) = %t, want %t", who, got, want)
+		}
+	}
+
+	*jobAccess = "all"
+	if !a.mayAccess(as("bob"), "alice") {
+		t.Error("mayAccess(bob, alice) = false with job_access=all")
+	}
+}
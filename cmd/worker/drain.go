@@ -0,0 +1,209 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dominichamon/sprinkle/internal"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+var (
+	drainTimeout = flag.Duration("drain_timeout", 10*time.Minute, "How long a draining worker waits for running jobs to complete before cancelling them")
+	drainGrace   = flag.Duration("drain_grace", 10*time.Second, "How long a draining worker waits for cancelled jobs to exit before killing them, and for RPCs to finish before stopping")
+
+	drain drainState
+)
+
+// drainState tracks whether the worker is draining, and what to stop once it has.
+type drainState struct {
+	sync.Mutex
+	draining bool
+	deadline time.Time
+	// admitting counts Run calls that were accepted before draining started and may yet start a job.
+	admitting int
+	// announcers make the worker discoverable until it starts draining.
+	announcers []internal.Announcer
+	// done is closed once running jobs have completed or been killed.
+	done chan struct{}
+}
+
+func init() {
+	drain.Lock()
+	drain.done = make(chan struct{})
+	drain.Unlock()
+}
+
+// active reports whether the worker has started draining.
+func (d *drainState) active() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.draining
+}
+
+// admit reports whether a job may be run, and if so counts it as being admitted until admitted is called.
+func (d *drainState) admit() bool {
+	d.Lock()
+	defer d.Unlock()
+	if d.draining {
+		return false
+	}
+	d.admitting++
+	return true
+}
+
+// admitted is called once an admitted job has started or been rejected.
+func (d *drainState) admitted() {
+	d.Lock()
+	defer d.Unlock()
+	d.admitting--
+}
+
+// start begins draining, if the worker isn't already, with running jobs cancelled after timeout. If it is
+// already draining, the deadline is only brought forward. It returns the deadline.
+func (d *drainState) start(timeout time.Duration, reason string) time.Time {
+	d.Lock()
+	defer d.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	if d.draining {
+		if deadline.Before(d.deadline) {
+			glog.Infof("cancelling running jobs at %s: %s", deadline, reason)
+			d.deadline = deadline
+		}
+		return d.deadline
+	}
+
+	glog.Infof("draining until %s: %s", deadline, reason)
+	d.draining = true
+	d.deadline = deadline
+	for _, a := range d.announcers {
+		if err := a.Close(); err != nil {
+			glog.Warningf("failed to stop announcing worker: %s", err)
+		}
+	}
+	d.announcers = nil
+	go d.wait()
+	return d.deadline
+}
+
+// running returns the jobs that have not yet completed.
+func running() map[int64]job {
+	jobs.RLock()
+	defer jobs.RUnlock()
+	js := make(map[int64]job)
+	for id, j := range jobs.jobs {
+		if !j.complete {
+			js[id] = j
+		}
+	}
+	return js
+}
+
+// wait waits for running jobs to complete, cancelling them once the deadline passes and killing them if they
+// outlive the grace period, then closes done.
+func (d *drainState) wait() {
+	if gossip != nil {
+		if err := gossip.Leave(*drainGrace); err != nil {
+			glog.Warningf("failed to leave gossip: %s", err)
+		}
+	}
+	if st, err := (&workerServer{}).Status(context.Background(), &pb.StatusRequest{}); err == nil {
+		watch.publish(&pb.WatchEvent{Type: pb.WatchEvent_TYPE_DRAINING, Status: st})
+	} else {
+		glog.Warningf("failed to get status: %s", err)
+	}
+
+	var cancelled, killed bool
+	for range time.Tick(time.Second) {
+		d.Lock()
+		deadline, admitting := d.deadline, d.admitting
+		d.Unlock()
+		js := running()
+		if len(js) == 0 && admitting == 0 {
+			break
+		}
+
+		now := time.Now()
+		switch {
+		case !cancelled && now.After(deadline):
+			cancelled = true
+			for id, j := range js {
+				glog.Infof("cancelling job %d to drain", id)
+				audit.jobEvent("job_cancelled", id, "", "draining")
+				publishJob(pb.WatchEvent_TYPE_JOB_CANCELLED, id, j, "draining")
+				syscall.Kill(-j.cmd.Process.Pid, syscall.SIGTERM)
+			}
+		case !killed && now.After(deadline.Add(*drainGrace)):
+			killed = true
+			for id, j := range js {
+				glog.Warningf("killing job %d to drain", id)
+				syscall.Kill(-j.cmd.Process.Pid, syscall.SIGKILL)
+			}
+		case now.After(deadline.Add(2 * *drainGrace)):
+			glog.Errorf("giving up on %d jobs that survived being killed", len(js))
+			close(d.done)
+			return
+		}
+	}
+	glog.Info("drained")
+	close(d.done)
+}
+
+// handleSignals drains the worker on SIGTERM or SIGINT. A signal received while already draining cancels running
+// jobs immediately.
+func handleSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	for sig := range ch {
+		timeout := *drainTimeout
+		if drain.active() {
+			timeout = 0
+		}
+		drain.start(timeout, "received "+sig.String())
+	}
+}
+
+// shutdownWhenDrained stops serving RPCs once the worker has drained. Watchers are disconnected so that the
+// server can stop gracefully, and RPCs that outlive the grace period are cut off.
+func shutdownWhenDrained(s *grpc.Server) {
+	<-drain.done
+	watch.close()
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(*drainGrace):
+		glog.Warning("stopping with RPCs still in progress")
+		s.Stop()
+	}
+}
+
+func (s *workerServer) Drain(ctx context.Context, req *pb.DrainRequest) (*pb.DrainResponse, error) {
+	if auth.required() && !auth.admins[caller(ctx)] {
+		return nil, status.Errorf(codes.PermissionDenied, "%q may not drain the worker", caller(ctx))
+	}
+	timeout := *drainTimeout
+	if req.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.TimeoutSeconds) * time.Second
+	}
+	deadline := drain.start(timeout, fmt.Sprintf("requested by %q from %s", caller(ctx), peerAddr(ctx)))
+	return &pb.DrainResponse{
+		Running:  int32(len(running())),
+		Deadline: deadline.Unix(),
+	}, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/dominichamon/sprinkle/internal"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+var (
+	gossip *internal.Gossip
+
+	gossipPort = flag.Int("gossip_port", 0, "The port on which to gossip cluster membership with other workers. Gossip is disabled if 0")
+	gossipJoin = flag.String("gossip_join", "", "Comma-separated host:gossip_port addresses of workers to join the gossip through")
+)
+
+// startGossip joins this worker to its cluster's gossip membership.
+func startGossip(key []byte) error {
+	ip, err := advertisedIP()
+	if err != nil {
+		return err
+	}
+
+	var join []string
+	for _, j := range strings.Split(*gossipJoin, ",") {
+		if j = strings.TrimSpace(j); j != "" {
+			join = append(join, j)
+		}
+	}
+
+	gossip, err = internal.JoinGossip(internal.GossipConfig{
+		Addr:        net.JoinHostPort(ip.String(), fmt.Sprintf("%d", *port)),
+		BindPort:    *gossipPort,
+		AdvertiseIP: ip,
+		Cluster:     *cluster,
+		Key:         key,
+		Join:        join,
+	})
+	return err
+}
+
+func (s *workerServer) Members(_ context.Context, _ *pb.MembersRequest) (*pb.MembersResponse, error) {
+	if gossip == nil {
+		return &pb.MembersResponse{}, nil
+	}
+	return &pb.MembersResponse{Members: gossip.Members()}, nil
+}
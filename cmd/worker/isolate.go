@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var (
+	runAs            = flag.String("run_as", "", "The local user, as a name or uid[:gid], to run jobs as. Jobs run as the worker's user if unset")
+	mapUsers         = flag.Bool("map_users", false, "Whether to run jobs as the local account with the same username as the authenticated submitter, falling back to run_as. Submitters are never mapped to root")
+	jobRoot          = flag.String("job_dir", "", "Directory in which to create a fresh working directory for each job. Jobs run in the worker's directory if unset")
+	namespaceList    = flag.String("namespaces", "", "Comma-separated Linux namespaces to run each job in: mount, pid, net")
+	requireIsolation = flag.Bool("require_isolation", false, "Whether to refuse to run jobs as root or outside a per-job directory")
+
+	// cloneflags are the namespaces to run jobs in.
+	cloneflags uintptr
+)
+
+// account is a local user that jobs may run as.
+type account struct {
+	name     string
+	home     string
+	uid, gid uint32
+	groups   []uint32
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
+
+// errRootOwner is returned for owners whose local account is root or in the root group.
+var errRootOwner = errors.New("refusing to map owner to root")
+
+// newAccount returns the account of u with the primary group gid.
+func newAccount(u *user.User, gid string) (*account, error) {
+	a := &account{name: u.Username, home: u.HomeDir}
+	var err error
+	if a.uid, err = parseID(u.Uid); err != nil {
+		return nil, err
+	}
+	if a.gid, err = parseID(gid); err != nil {
+		return nil, err
+	}
+	if gids, err := u.GroupIds(); err == nil {
+		for _, g := range gids {
+			if id, err := parseID(g); err == nil {
+				a.groups = append(a.groups, id)
+			}
+		}
+	}
+	return a, nil
+}
+
+// lookupAccount finds the local account with the given name, or the given uid[:gid]. It is only for run_as, which
+// the operator sets.
+func lookupAccount(s string) (*account, error) {
+	var u *user.User
+	var err error
+	id := strings.SplitN(s, ":", 2)
+	if _, perr := parseID(id[0]); perr == nil {
+		u, err = user.LookupId(id[0])
+		if _, ok := err.(user.UnknownUserIdError); ok {
+			// Allow uids without an entry in the password database.
+			u, err = &user.User{Uid: id[0], Gid: id[0], Username: id[0]}, nil
+		}
+	} else {
+		u, err = user.Lookup(id[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	gid := u.Gid
+	if len(id) == 2 {
+		gid = id[1]
+	}
+	return newAccount(u, gid)
+}
+
+// lookupOwner finds the local account named after an authenticated owner. As owners come from callers' tokens and
+// certificates, they are only matched by username, never as ids, and never map to root or the root group; the
+// root group is dropped from the account's supplementary groups.
+func lookupOwner(owner string) (*account, error) {
+	u, err := user.Lookup(owner)
+	if err != nil {
+		return nil, err
+	}
+	a, err := newAccount(u, u.Gid)
+	if err != nil {
+		return nil, err
+	}
+	if a.uid == 0 || a.gid == 0 {
+		return nil, fmt.Errorf("%w: %q", errRootOwner, owner)
+	}
+	groups := a.groups[:0]
+	for _, g := range a.groups {
+		if g != 0 {
+			groups = append(groups, g)
+		}
+	}
+	a.groups = groups
+	return a, nil
+}
+
+// jobAccount returns the account a job submitted by owner should run as, or nil to run as the worker's user.
+func jobAccount(owner string) (*account, error) {
+	if *mapUsers && owner != "" {
+		a, err := lookupOwner(owner)
+		if err == nil || errors.Is(err, errRootOwner) {
+			return a, err
+		}
+		if *runAs == "" {
+			return nil, fmt.Errorf("no local account for %q: %s", owner, err)
+		}
+	}
+	if *runAs == "" {
+		return nil, nil
+	}
+	return lookupAccount(*runAs)
+}
+
+// setupIsolation checks the isolation flags are consistent.
+func setupIsolation() error {
+	var err error
+	cloneflags, err = parseNamespaces(*namespaceList)
+	if err != nil {
+		return err
+	}
+	if *runAs != "" {
+		if _, err := lookupAccount(*runAs); err != nil {
+			return fmt.Errorf("failed to find run_as user: %s", err)
+		}
+	}
+	if *requireIsolation {
+		if *runAs == "" && !*mapUsers && os.Geteuid() == 0 {
+			return errors.New("require_isolation needs run_as or map_users when running as root")
+		}
+		if *jobRoot == "" {
+			return errors.New("require_isolation needs job_dir")
+		}
+	}
+	return nil
+}
+
+// isolate configures cmd to run as the appropriate account for owner, in a fresh working directory and any
+// configured namespaces. It returns the working directory, which should be removed when the job completes.
+func isolate(cmd *exec.Cmd, owner string) (string, error) {
+	a, err := jobAccount(owner)
+	if err != nil {
+		return "", err
+	}
+	if *requireIsolation && (a == nil && os.Geteuid() == 0 || a != nil && a.uid == 0) {
+		return "", errors.New("refusing to run job as root")
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	setNamespaces(cmd.SysProcAttr, cloneflags)
+
+	// Only change credentials when they differ, as doing so requires privileges.
+	if a != nil && (int(a.uid) != os.Geteuid() || int(a.gid) != os.Getegid()) {
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: a.uid, Gid: a.gid, Groups: a.groups}
+	}
+	if a != nil {
+		cmd.Env = append(os.Environ(), "USER="+a.name, "LOGNAME="+a.name)
+		if a.home != "" {
+			cmd.Env = append(cmd.Env, "HOME="+a.home)
+		}
+	}
+
+	if *jobRoot == "" {
+		return "", nil
+	}
+	dir, err := ioutil.TempDir(*jobRoot, "job-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create job directory: %s", err)
+	}
+	if a != nil {
+		if err := os.Chown(dir, int(a.uid), int(a.gid)); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("failed to chown job directory: %s", err)
+		}
+	}
+	cmd.Dir = dir
+	return dir, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+var namespaces = map[string]uintptr{
+	"mount": syscall.CLONE_NEWNS,
+	"pid":   syscall.CLONE_NEWPID,
+	"net":   syscall.CLONE_NEWNET,
+}
+
+// parseNamespaces converts a comma-separated list of namespace names to clone flags.
+func parseNamespaces(list string) (uintptr, error) {
+	var flags uintptr
+	for _, n := range strings.Split(list, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		f, ok := namespaces[n]
+		if !ok {
+			return 0, fmt.Errorf("unknown namespace %q", n)
+		}
+		flags |= f
+	}
+	return flags, nil
+}
+
+func setNamespaces(attr *syscall.SysProcAttr, flags uintptr) {
+	attr.Cloneflags = flags
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+)
+
+// parseNamespaces fails if any namespaces are requested, as they are only supported on Linux.
+func parseNamespaces(list string) (uintptr, error) {
+	if strings.TrimSpace(strings.Replace(list, ",", "", -1)) != "" {
+		return 0, errors.New("namespaces are only supported on linux")
+	}
+	return 0, nil
+}
+
+func setNamespaces(_ *syscall.SysProcAttr, _ uintptr) {}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"os/user"
+	"testing"
+)
+
+func TestJobAccountMapsOwnersByName(t *testing.T) {
+	defer func(m bool, r string) { *mapUsers, *runAs = m, r }(*mapUsers, *runAs)
+	*mapUsers, *runAs = true, ""
+
+	for _, owner := range []string{"root", "0", "0:0", "1000:0"} {
+		if a, err := jobAccount(owner); err == nil {
+			t.Errorf("jobAccount(%q) = %+v, want an error", owner, a)
+		}
+	}
+	if _, err := jobAccount("root"); !errors.Is(err, errRootOwner) {
+		t.Errorf("jobAccount(root) = %v, want %v", err, errRootOwner)
+	}
+
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip(err)
+	}
+	a, err := jobAccount("nobody")
+	if err != nil {
+		t.Fatalf("jobAccount(nobody): %s", err)
+	}
+	if uid, _ := parseID(u.Uid); a.uid != uid {
+		t.Errorf("jobAccount(nobody) has uid %d, want %d", a.uid, uid)
+	}
+
+	// Numeric ids are still accepted from run_as, which the operator sets.
+	*runAs = "0:0"
+	if a, err := jobAccount("unknown-owner"); err != nil || a.uid != 0 || a.gid != 0 {
+		t.Errorf("jobAccount with run_as=0:0 = %+v, %v; want uid and gid 0", a, err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sync"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+// logLine is a line of a job's output.
+type logLine struct {
+	t    pb.LogType
+	text string
+}
+
+// jobLogs collects a job's output as it is written, so it can be streamed while the job runs.
+type jobLogs struct {
+	sync.Mutex
+	lines []logLine
+	done  bool
+	// changed is closed, and replaced, whenever lines are added or the logs are done.
+	changed chan struct{}
+}
+
+func newJobLogs() *jobLogs {
+	return &jobLogs{changed: make(chan struct{})}
+}
+
+func (l *jobLogs) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *jobLogs) add(t pb.LogType, text string) {
+	l.Lock()
+	l.lines = append(l.lines, logLine{t: t, text: text})
+	l.notify()
+	l.Unlock()
+}
+
+// finish marks the logs as complete.
+func (l *jobLogs) finish() {
+	l.Lock()
+	l.done = true
+	l.notify()
+	l.Unlock()
+}
+
+// read reads lines from r until EOF.
+func (l *jobLogs) read(t pb.LogType, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		s, err := br.ReadString('\n')
+		if s != "" {
+			l.add(t, s)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// since returns the lines from index i onwards, whether there will be no more, and a channel that is closed when
+// that changes.
+func (l *jobLogs) since(i int) ([]logLine, bool, <-chan struct{}) {
+	l.Lock()
+	defer l.Unlock()
+	if i > len(l.lines) {
+		i = len(l.lines)
+	}
+	return l.lines[i:], l.done, l.changed
+}
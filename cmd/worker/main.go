@@ -2,132 +2,208 @@
 package main
 
 import (
-	"errors"
 	"flag"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/dominichamon/sprinkle/internal"
 	"github.com/golang/glog"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	pb "github.com/dominichamon/sprinkle/api/sprinkle"
 )
 
 var (
-	port  = flag.Int("port", 5432, "The port on which to listen for RPC requests")
-	addr  = flag.String("addr", "239.192.0.1:9999", "The multicast address to use for discovery")
-	iface = flag.String("iface", "", "The interface on which to listen for pings. Defaults to first that supports multicast if unset")
+	port   = flag.Int("port", 5432, "The port on which to listen for RPC requests")
+	addr   = flag.String("addr", "239.192.0.1:9999", "The multicast address to use for discovery. Multicast discovery is disabled if empty")
+	iface  = flag.String("iface", "", "The interface on which to listen for pings and whose address to advertise. Defaults to first that supports multicast if unset")
+	family = flag.String("family", "", "The address family (ip4 or ip6) to advertise. Defaults to that of addr, or ip4 if available")
+
+	cluster = flag.String("cluster", internal.DefaultCluster, "The cluster this worker belongs to. Only pings from the same cluster are answered")
+	keyFile = flag.String("discovery_key", "", "Path to a shared secret used to sign acks. If set, unsigned pings are ignored")
+
+	seeds            = flag.String("seeds", "", "Comma-separated host:port addresses of workers to register with")
+	seedsFile        = flag.String("seeds_file", "", "Path to a file of seed addresses, one per line")
+	registerInterval = flag.Duration("register_interval", 1*time.Minute, "The time to wait between registrations with seeds")
+	token            = flag.String("token", "", "The bearer token to present to seeds that require authentication. Defaults to $"+internal.TokenEnv+", then the contents of token_file")
+	tokenFile        = flag.String("token_file", "", "Path to a file containing the bearer token to present to seeds")
+
+	advertise = flag.Bool("mdns", false, "Whether to advertise the worker as a "+internal.MDNSService+" service via mDNS/DNS-SD")
+	labelList = flag.String("labels", "", "Comma-separated key=value labels describing the worker")
+
+	tlsCert = flag.String("tls_cert", "", "Path to the PEM certificate to serve RPCs with. RPCs are served in plaintext if unset")
+	tlsKey  = flag.String("tls_key", "", "Path to the PEM private key for tls_cert")
+	tlsCA   = flag.String("tls_ca", "", "Path to a PEM CA certificate. If set, clients must present a certificate signed by it")
+
+	labels map[string]string
 )
 
-func multicastInterface() (*net.Interface, error) {
-	if *iface != "" {
-		ifi, err := net.InterfaceByName(*iface)
-		if err != nil {
-			return nil, err
-		}
-		if ifi.Flags&net.FlagMulticast == 0 {
-			return nil, fmt.Errorf("iface %q does not support multicast", *iface)
+// advertisedIP returns the address at which clients should reach this worker.
+func advertisedIP() (net.IP, error) {
+	fam := *family
+	if fam == "" && *addr != "" {
+		if udpaddr, err := net.ResolveUDPAddr("udp", *addr); err == nil {
+			fam = internal.Family(udpaddr.IP)
 		}
-		return ifi, nil
 	}
+	return internal.ExternalIP(*iface, fam)
+}
 
-	// iface was not provided: search for the first multicast-supporting iface
-	ifis, err := net.Interfaces()
+// advertisedAddr returns the RPC address at which clients should reach this worker.
+func advertisedAddr() (string, error) {
+	ip, err := advertisedIP()
 	if err != nil {
-		return nil, err
-	}
-	for _, ifi := range ifis {
-		if ifi.Flags&net.FlagMulticast != 0 {
-			return &ifi, nil
-		}
+		return "", err
 	}
-	return nil, errors.New("no multicast interfaces found")
+	return net.JoinHostPort(ip.String(), fmt.Sprintf("%d", *port)), nil
 }
 
-func multicastListen(addr string) error {
-	if addr == "" {
-		return errors.New("expected valid addr")
+// announcers returns the ways in which the worker is made discoverable, as configured by flags.
+func announcers(key []byte) ([]internal.Announcer, error) {
+	var as []internal.Announcer
+	if *addr != "" {
+		as = append(as, &internal.Responder{
+			Transport: &internal.Multicast{Addr: *addr, Iface: *iface},
+			Codec:     internal.NewCodec(*cluster, key),
+			OnPing:    countPing,
+		})
 	}
 
-	udpaddr, err := net.ResolveUDPAddr("udp", addr)
+	ss, err := internal.ParseSeeds(*seeds, *seedsFile)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if len(ss) != 0 {
+		as = append(as, &internal.Registrar{
+			Seeds:    ss,
+			Cluster:  *cluster,
+			Interval: *registerInterval,
+		})
+	}
+
+	if *advertise {
+		as = append(as, &internal.MDNSAnnouncer{
+			Cluster: *cluster,
+			Labels:  labels,
+			Iface:   *iface,
+		})
 	}
+	return as, nil
+}
 
-	if !udpaddr.IP.IsMulticast() {
-		return fmt.Errorf("%q is not multicast", addr)
+// serverOptions configures TLS for serving RPCs and, as the worker also talks to its seeds, for dialing
+// other workers.
+func serverOptions() ([]grpc.ServerOption, error) {
+	files := internal.TLSFiles{Cert: *tlsCert, Key: *tlsKey, CA: *tlsCA}
+	if !files.Enabled() {
+		return nil, nil
 	}
 
-	ifi, err := multicastInterface()
+	server, err := files.ServerConfig()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	glog.Infof("multicast listening on %s %s", ifi.Name, udpaddr)
-
-	c, err := net.ListenMulticastUDP(udpaddr.Network(), ifi, udpaddr)
+	client, err := files.ClientConfig()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	internal.SetClientTLS(client)
 
-	go func() {
-		for {
-			b := make([]byte, 1024)
-			n, err := c.Read(b)
-			if err != nil {
-				glog.Error(err)
-				break
-			}
-			s := string(b[:n])
-
-			glog.Infof("discovery ping %s [%d]", s, n)
-
-			// Reply!
-			raddr, err := net.ResolveUDPAddr("udp", s)
-			if err != nil {
-				glog.Error(err)
-				continue
-			}
-
-			rc, err := net.DialUDP("udp", nil, raddr)
-			if err != nil {
-				glog.Error(err)
-				continue
-			}
-			defer rc.Close()
-
-			ip, err := internal.ExternalIP()
-			if err != nil {
-				glog.Error(err)
-				break
-			}
-
-			_, err = rc.Write([]byte(net.JoinHostPort(ip.String(), fmt.Sprintf("%d", *port))))
-			if err != nil {
-				glog.Error(err)
-				continue
-			}
-		}
-		c.Close()
-	}()
-	return nil
+	return []grpc.ServerOption{grpc.Creds(credentials.NewTLS(server))}, nil
 }
 
 func main() {
 	flag.Parse()
 
-	if err := multicastListen(*addr); err != nil {
-		glog.Exit("failed to listen for multicast: ", err)
+	var err error
+	labels, err = internal.ParseLabels(*labelList)
+	if err != nil {
+		glog.Exit("failed to parse labels: ", err)
+	}
+
+	key, err := internal.LoadKey(*keyFile)
+	if err != nil {
+		glog.Exit("failed to load discovery key: ", err)
 	}
 
+	if err := setupAuth(); err != nil {
+		glog.Exit(err)
+	}
+	t, err := internal.LoadToken(*token, *tokenFile)
+	if err != nil {
+		glog.Exit("failed to load token: ", err)
+	}
+	internal.SetToken(t)
+	if err := setupIsolation(); err != nil {
+		glog.Exit(err)
+	}
+	if err := setupPolicy(); err != nil {
+		glog.Exit(err)
+	}
+	if err := setupAudit(); err != nil {
+		glog.Exit("failed to open audit log: ", err)
+	}
+	if err := setupWatch(); err != nil {
+		glog.Exit(err)
+	}
+
+	opts, err := serverOptions()
+	if err != nil {
+		glog.Exit("failed to configure TLS: ", err)
+	}
+
+	self, err := advertisedAddr()
+	if err != nil {
+		glog.Exit("failed to determine address to advertise: ", err)
+	}
+
+	// Listen before announcing, as seeds check that registering workers answer.
 	l, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
 	if err != nil {
 		glog.Exit("failed to listen for job requests:", err)
 	}
+
+	as, err := announcers(key)
+	if err != nil {
+		glog.Exit("failed to configure discovery: ", err)
+	}
+	for _, a := range as {
+		if err := a.Announce(self); err != nil {
+			glog.Exit("failed to announce worker: ", err)
+		}
+	}
+	// Announcing stops once the worker starts draining.
+	drain.Lock()
+	drain.announcers = as
+	drain.Unlock()
+
+	if *gossipPort != 0 {
+		if err := startGossip(key); err != nil {
+			glog.Exit("failed to start gossip: ", err)
+		}
+	}
+
+	serveMetrics()
+	go watchResources()
+
 	glog.Infof("starting worker on port %d", *port)
-	s := grpc.NewServer()
+	// Audit first so that calls rejected by authentication are recorded too.
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(unaryMetrics, audit.unary, auth.unary),
+		grpc.ChainStreamInterceptor(streamMetrics, audit.stream, auth.stream))
+	s := grpc.NewServer(opts...)
 	pb.RegisterWorkerServer(s, &workerServer{})
 	glog.Infof("listening on port %d", *port)
-	s.Serve(l)
+	go handleSignals()
+	go func() {
+		if err := s.Serve(l); err != nil {
+			glog.Exit("failed to serve: ", err)
+		}
+	}()
+	shutdownWhenDrained(s)
+	glog.Info("shut down")
+	glog.Flush()
 }
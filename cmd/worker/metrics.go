@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+var (
+	metricsPort = flag.Int("metrics_port", 0, "The port on which to serve Prometheus metrics over HTTP. Metrics are not served if 0")
+
+	jobsStarted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sprinkle_jobs_started_total",
+		Help: "Jobs started.",
+	})
+	jobsSucceeded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sprinkle_jobs_succeeded_total",
+		Help: "Jobs that exited successfully.",
+	})
+	jobsFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sprinkle_jobs_failed_total",
+		Help: "Jobs that exited unsuccessfully, including those cancelled or timed out.",
+	})
+	jobsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sprinkle_jobs_rejected_total",
+		Help: "Jobs rejected before starting, by reason.",
+	}, []string{"reason"})
+	jobDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "sprinkle_job_duration_seconds",
+		Help:    "How long jobs ran for.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	})
+	rpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "sprinkle_rpc_duration_seconds",
+		Help: "How long RPCs took to handle, by method and status code.",
+	}, []string{"method", "code"})
+	pings = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sprinkle_discovery_pings_total",
+		Help: "Discovery pings received, by whether they were answered or ignored.",
+	}, []string{"result"})
+)
+
+func init() {
+	gauge := func(name, help string, f func() float64) {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, f)
+	}
+
+	gauge("sprinkle_ram_total_bytes", "Total RAM.", func() float64 {
+		total, _, err := ram()
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(total)
+	})
+	gauge("sprinkle_ram_free_bytes", "Available RAM.", func() float64 {
+		_, avail, err := ram()
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(avail)
+	})
+	gauge("sprinkle_load1", "One minute load average.", func() float64 {
+		load1, _, err := load()
+		if err != nil {
+			return math.NaN()
+		}
+		return load1
+	})
+	gauge("sprinkle_load5", "Five minute load average.", func() float64 {
+		_, load5, err := load()
+		if err != nil {
+			return math.NaN()
+		}
+		return load5
+	})
+	gauge("sprinkle_reserved_ram_bytes", "RAM requested by running jobs.", func() float64 {
+		jobs.RLock()
+		defer jobs.RUnlock()
+		var reserved uint64
+		for _, j := range jobs.jobs {
+			if !j.complete {
+				reserved += j.ram
+			}
+		}
+		return float64(reserved)
+	})
+
+	// Jobs are not queued yet, so pending is always zero.
+	for _, state := range []pb.JobResponse_State{pb.JobResponse_STATE_PENDING, pb.JobResponse_STATE_RUNNING, pb.JobResponse_STATE_COMPLETE} {
+		state := state
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "sprinkle_jobs",
+			Help:        "Jobs known to the worker, by state.",
+			ConstLabels: prometheus.Labels{"state": strings.ToLower(strings.TrimPrefix(state.String(), "STATE_"))},
+		}, func() float64 {
+			jobs.RLock()
+			defer jobs.RUnlock()
+			n := 0
+			for _, j := range jobs.jobs {
+				if j.complete == (state == pb.JobResponse_STATE_COMPLETE) && state != pb.JobResponse_STATE_PENDING {
+					n++
+				}
+			}
+			return float64(n)
+		})
+	}
+}
+
+// jobCompleted updates metrics for a completed job.
+func jobCompleted(j job) {
+	jobDuration.Observe(j.end.Sub(j.start).Seconds())
+	if j.cmd.ProcessState != nil && j.cmd.ProcessState.Success() {
+		jobsSucceeded.Inc()
+	} else {
+		jobsFailed.Inc()
+	}
+}
+
+func countPing(answered bool) {
+	if answered {
+		pings.WithLabelValues("answered").Inc()
+	} else {
+		pings.WithLabelValues("ignored").Inc()
+	}
+}
+
+func observeRPC(method string, start time.Time, err error) {
+	rpcDuration.WithLabelValues(method, status.Code(err).String()).Observe(time.Since(start).Seconds())
+}
+
+func unaryMetrics(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observeRPC(info.FullMethod, start, err)
+	return resp, err
+}
+
+func streamMetrics(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observeRPC(info.FullMethod, start, err)
+	return err
+}
+
+// serveMetrics serves Prometheus metrics over HTTP if a metrics port is set.
+func serveMetrics() {
+	if *metricsPort == 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	glog.Infof("serving metrics on port %d", *metricsPort)
+	go func() {
+		glog.Error(http.ListenAndServe(fmt.Sprintf(":%d", *metricsPort), mux))
+	}()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+var (
+	admission *policy
+
+	policyFile = flag.String("policy", "", "Path to a JSON admission policy that jobs must satisfy before they are run")
+)
+
+// duration is a time.Duration that is read from JSON as a string such as "1h30m".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// rule is a named constraint on jobs. Every rule that applies to a job's owner must be satisfied for the job to
+// be admitted.
+type rule struct {
+	Name string `json:"name"`
+	// Users the rule applies to. It applies to everyone if empty.
+	Users []string `json:"users"`
+	// Executables that commands may run. Any are allowed if empty. A path allows only commands given as exactly
+	// that path. A bare name allows only commands given as that bare name, which the shell looks up in PATH, and
+	// not a program of the same name elsewhere, such as one written by an earlier job.
+	Executables []string `json:"executables"`
+	// Deny are regular expressions that commands must not match.
+	Deny []string `json:"deny"`
+	// Labels that jobs must carry. An empty value allows any value.
+	Labels map[string]string `json:"labels"`
+	// MaxRAM is the most RAM a job may request. Unlimited if zero.
+	MaxRAM uint64 `json:"max_ram"`
+	// MaxTimeout is the longest timeout a job may request. If set, jobs must request a timeout.
+	MaxTimeout duration `json:"max_timeout"`
+	// EnvAllow are the environment variables jobs may set, where a trailing * matches any suffix. Any but the
+	// unsafe ones are allowed if empty. Listing an unsafe variable here allows it for the rule's users.
+	EnvAllow []string `json:"env_allow"`
+	// EnvDeny are environment variables jobs may not set, where a trailing * matches any suffix.
+	EnvDeny []string `json:"env_deny"`
+
+	deny []*regexp.Regexp
+}
+
+type policy struct {
+	Rules []*rule `json:"rules"`
+}
+
+func loadPolicy(p string) (*policy, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	pol := &policy{}
+	if err := json.Unmarshal(b, pol); err != nil {
+		return nil, fmt.Errorf("failed to parse policy %q: %s", p, err)
+	}
+	for i, r := range pol.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule %d", i)
+		}
+		for _, d := range r.Deny {
+			re, err := regexp.Compile(d)
+			if err != nil {
+				return nil, fmt.Errorf("bad deny pattern in %q: %s", r.Name, err)
+			}
+			r.deny = append(r.deny, re)
+		}
+	}
+	return pol, nil
+}
+
+// setupPolicy loads the admission policy, if any.
+func setupPolicy() error {
+	if *policyFile == "" {
+		return nil
+	}
+	var err error
+	admission, err = loadPolicy(*policyFile)
+	return err
+}
+
+var (
+	// unsafeEnv are environment variables that change which programs run or how they are loaded, so could get
+	// around a policy's executables. Jobs may only set them if a rule that applies to them allows it.
+	unsafeEnv = []string{"LD_*", "BASH_ENV", "ENV", "PATH"}
+	// isolationEnv are set by the worker to match the account a job runs as, and may never be set by jobs.
+	isolationEnv = []string{"USER", "LOGNAME", "HOME"}
+)
+
+// reservedEnvRule names the built-in rule on unsafe and isolation environment variables in policy violations.
+const reservedEnvRule = "reserved-env"
+
+// matchEnv reports whether key is one of patterns, where a trailing * matches any suffix.
+func matchEnv(patterns []string, key string) bool {
+	for _, p := range patterns {
+		if p == key || strings.HasSuffix(p, "*") && strings.HasPrefix(key, strings.TrimSuffix(p, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func envKeys(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	commandSeparator = regexp.MustCompile("[;&|()`\n]+|\\$\\(")
+	assignment       = regexp.MustCompile("^([A-Za-z_][A-Za-z0-9_]*)\\+?=")
+	shellKeywords    = map[string]bool{
+		"!": true, "{": true, "}": true, "if": true, "then": true, "elif": true, "else": true, "fi": true,
+		"for": true, "while": true, "until": true, "do": true, "done": true, "case": true, "esac": true,
+		"in": true, "exec": true, "time": true,
+	}
+)
+
+// executables returns the programs a shell command runs. It is a best effort that does not understand quoting or
+// expansions, so denylists should be used to reject anything it cannot see.
+func executables(cmd string) []string {
+	var exes []string
+	for _, part := range commandSeparator.Split(cmd, -1) {
+		for _, f := range strings.Fields(part) {
+			if assignment.MatchString(f) || shellKeywords[f] {
+				continue
+			}
+			exes = append(exes, f)
+			break
+		}
+	}
+	return exes
+}
+
+// assignments returns the names of the variables a shell command assigns, wherever the assignments appear, such
+// as before a program or after export. Like executables, it is a best effort.
+func assignments(cmd string) []string {
+	var names []string
+	for _, part := range commandSeparator.Split(cmd, -1) {
+		for _, f := range strings.Fields(part) {
+			if m := assignment.FindStringSubmatch(f); m != nil {
+				names = append(names, m[1])
+			}
+		}
+	}
+	return names
+}
+
+func (r *rule) appliesTo(user string) bool {
+	if len(r.Users) == 0 {
+		return true
+	}
+	for _, u := range r.Users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) allows(exe string) bool {
+	for _, e := range r.Executables {
+		if e == exe {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns why the job violates the rule, or an empty string if it does not.
+func (r *rule) check(req *pb.RunRequest) string {
+	if len(r.Executables) != 0 {
+		for _, exe := range executables(req.Cmd) {
+			if !r.allows(exe) {
+				return fmt.Sprintf("executable %q is not allowed", exe)
+			}
+		}
+	}
+	for _, re := range r.deny {
+		if re.MatchString(req.Cmd) {
+			return fmt.Sprintf("command matches %q", re)
+		}
+	}
+	for k, v := range r.Labels {
+		got, ok := req.Labels[k]
+		if !ok {
+			return fmt.Sprintf("label %q is required", k)
+		}
+		if v != "" && got != v {
+			return fmt.Sprintf("label %q must be %q", k, v)
+		}
+	}
+	if r.MaxRAM != 0 && req.Ram > r.MaxRAM {
+		return fmt.Sprintf("requested RAM %d exceeds %d", req.Ram, r.MaxRAM)
+	}
+	for _, k := range envKeys(req.Env) {
+		if matchEnv(r.EnvDeny, k) || len(r.EnvAllow) != 0 && !matchEnv(r.EnvAllow, k) {
+			return fmt.Sprintf("environment variable %q is not allowed", k)
+		}
+	}
+	if max := time.Duration(r.MaxTimeout); max != 0 {
+		timeout := time.Duration(req.TimeoutSeconds) * time.Second
+		if timeout == 0 || timeout > max {
+			return fmt.Sprintf("timeout must be set and at most %s", max)
+		}
+	}
+	return ""
+}
+
+// allowsEnv reports whether a rule that applies to user allows it to set the environment variable key.
+func (p *policy) allowsEnv(user, key string) bool {
+	if p == nil {
+		return false
+	}
+	for _, r := range p.Rules {
+		if r.appliesTo(user) && matchEnv(r.EnvAllow, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAssignments returns why the command may not assign a variable under a rule that restricts executables,
+// or an empty string if it may. Unsafe variables could otherwise run programs other than the allowed ones.
+func (p *policy) checkAssignments(user, cmd string) string {
+	for _, k := range assignments(cmd) {
+		if matchEnv(unsafeEnv, k) && !p.allowsEnv(user, k) {
+			return fmt.Sprintf("command sets environment variable %q", k)
+		}
+	}
+	return ""
+}
+
+// checkEnv returns why the job's environment may not be set whatever the rules, or an empty string if it may.
+func (p *policy) checkEnv(user string, env map[string]string) string {
+	for _, k := range envKeys(env) {
+		if matchEnv(isolationEnv, k) {
+			return fmt.Sprintf("environment variable %q is set by the worker", k)
+		}
+		if matchEnv(unsafeEnv, k) && !p.allowsEnv(user, k) {
+			return fmt.Sprintf("environment variable %q is not allowed unless a policy rule allows it", k)
+		}
+	}
+	return ""
+}
+
+func violation(rule, reason string) error {
+	st := status.Newf(codes.PermissionDenied, "violates policy rule %q: %s", rule, reason)
+	if d, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   "POLICY_VIOLATION",
+		Domain:   "sprinkle",
+		Metadata: map[string]string{"rule": rule, "reason": reason},
+	}); err == nil {
+		st = d
+	}
+	return st.Err()
+}
+
+// admit returns a PermissionDenied status naming the first rule the job violates, or nil if it is admitted. The
+// built-in rule on unsafe and isolation environment variables applies even without a policy.
+func (p *policy) admit(user string, req *pb.RunRequest) error {
+	if reason := p.checkEnv(user, req.Env); reason != "" {
+		return violation(reservedEnvRule, reason)
+	}
+	if p == nil {
+		return nil
+	}
+	for _, r := range p.Rules {
+		if !r.appliesTo(user) {
+			continue
+		}
+		reason := r.check(req)
+		if reason == "" && len(r.Executables) != 0 {
+			reason = p.checkAssignments(user, req.Cmd)
+		}
+		if reason != "" {
+			return violation(r.Name, reason)
+		}
+	}
+	return nil
+}
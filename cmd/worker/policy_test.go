@@ -0,0 +1,145 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+func TestExecutables(t *testing.T) {
+	for cmd, want := range map[string][]string{
+		"echo hello":                       {"echo"},
+		"FOO=1 make -j4 && ./test | tee x": {"make", "./test", "tee"},
+		"if true; then rm -rf /; fi":       {"true", "rm"},
+		"echo $(curl evil)":                {"echo", "curl"},
+	} {
+		if got := executables(cmd); !reflect.DeepEqual(got, want) {
+			t.Errorf("executables(%q) = %q, want %q", cmd, got, want)
+		}
+	}
+
+	for cmd, want := range map[string][]string{
+		"echo hello":                   nil,
+		"PATH=/tmp/evil; ls":           {"PATH"},
+		"LD_PRELOAD=/tmp/x.so ls":      {"LD_PRELOAD"},
+		"ls && export BASH_ENV=/tmp/x": {"BASH_ENV"},
+		"PATH+=:/tmp ls":               {"PATH"},
+	} {
+		if got := assignments(cmd); !reflect.DeepEqual(got, want) {
+			t.Errorf("assignments(%q) = %q, want %q", cmd, got, want)
+		}
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	p := &policy{Rules: []*rule{
+		{Name: "tools", Executables: []string{"echo", "/usr/bin/make"}},
+		{Name: "no-sudo", Deny: []string{`\bsudo\b`}},
+		{Name: "team", Users: []string{"bob"}, Labels: map[string]string{"team": ""}},
+		{Name: "carol-env", Users: []string{"carol"}, EnvAllow: []string{"LD_LIBRARY_PATH"}},
+		{Name: "limits", Users: []string{"bob"}, MaxRAM: 100, MaxTimeout: duration(time.Minute)},
+	}}
+	p.Rules[1].deny = []*regexp.Regexp{regexp.MustCompile(p.Rules[1].Deny[0])}
+
+	for _, tc := range []struct {
+		user string
+		req  *pb.RunRequest
+		rule string
+	}{
+		{"alice", &pb.RunRequest{Cmd: "echo hi && /usr/bin/make"}, ""},
+		{"alice", &pb.RunRequest{Cmd: "make"}, "tools"},
+		{"alice", &pb.RunRequest{Cmd: "/usr/local/bin/make"}, "tools"},
+		{"alice", &pb.RunRequest{Cmd: "/tmp/evil/echo hi"}, "tools"},
+		{"alice", &pb.RunRequest{Cmd: "./echo hi"}, "tools"},
+		{"alice", &pb.RunRequest{Cmd: "/usr/bin/echo hi"}, "tools"},
+		{"alice", &pb.RunRequest{Cmd: "curl x"}, "tools"},
+		{"alice", &pb.RunRequest{Cmd: "echo sudo"}, "no-sudo"},
+		{"alice", &pb.RunRequest{Cmd: "PATH=/tmp/evil; echo hi"}, "tools"},
+		{"alice", &pb.RunRequest{Cmd: "LD_PRELOAD=/tmp/x.so echo hi"}, "tools"},
+		{"alice", &pb.RunRequest{Cmd: "echo hi; export ENV=/tmp/x"}, "tools"},
+		{"alice", &pb.RunRequest{Cmd: "FOO=1 echo hi"}, ""},
+		{"carol", &pb.RunRequest{Cmd: "LD_LIBRARY_PATH=/opt/lib echo hi"}, ""},
+		{"carol", &pb.RunRequest{Cmd: "LD_PRELOAD=/tmp/x.so echo hi"}, "tools"},
+		{"alice", &pb.RunRequest{Cmd: "echo", Ram: 1000}, ""},
+		{"bob", &pb.RunRequest{Cmd: "echo"}, "team"},
+		{"bob", &pb.RunRequest{Cmd: "echo", Labels: map[string]string{"team": "a"}}, "limits"},
+		{"bob", &pb.RunRequest{Cmd: "echo", Labels: map[string]string{"team": "a"}, TimeoutSeconds: 30}, ""},
+		{"bob", &pb.RunRequest{Cmd: "echo", Labels: map[string]string{"team": "a"}, TimeoutSeconds: 30, Ram: 101}, "limits"},
+	} {
+		err := p.admit(tc.user, tc.req)
+		if tc.rule == "" {
+			if err != nil {
+				t.Errorf("admit(%q, %v) = %s, want nil", tc.user, tc.req, err)
+			}
+			continue
+		}
+
+		if rule := violatedRule(t, err); rule != tc.rule {
+			t.Errorf("admit(%q, %v) violated %q, want %q", tc.user, tc.req, rule, tc.rule)
+		}
+	}
+}
+
+// violatedRule returns the rule named by a policy violation, or an empty string if err is nil.
+func violatedRule(t *testing.T, err error) string {
+	t.Helper()
+	if err == nil {
+		return ""
+	}
+	st := status.Convert(err)
+	if st.Code() != codes.PermissionDenied {
+		t.Errorf("got %s, want PermissionDenied", err)
+		return ""
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			return info.Metadata["rule"]
+		}
+	}
+	t.Errorf("%s names no rule", err)
+	return ""
+}
+
+func TestAdmitEnv(t *testing.T) {
+	p := &policy{Rules: []*rule{
+		{Name: "alice-env", Users: []string{"alice"}, EnvAllow: []string{"PATH", "LD_LIBRARY_PATH", "APP_*"}},
+		{Name: "no-secrets", EnvDeny: []string{"SECRET*"}},
+	}}
+
+	for _, tc := range []struct {
+		p    *policy
+		user string
+		env  string
+		rule string
+	}{
+		// Without a policy, only the reserved variables are refused.
+		{nil, "bob", "FOO", ""},
+		{nil, "bob", "PATH", reservedEnvRule},
+		{nil, "bob", "LD_PRELOAD", reservedEnvRule},
+		{nil, "bob", "BASH_ENV", reservedEnvRule},
+		{nil, "bob", "ENV", reservedEnvRule},
+		{nil, "bob", "HOME", reservedEnvRule},
+		{nil, "bob", "USER", reservedEnvRule},
+		{p, "alice", "PATH", ""},
+		{p, "alice", "LD_LIBRARY_PATH", ""},
+		{p, "alice", "APP_MODE", ""},
+		{p, "alice", "LD_PRELOAD", reservedEnvRule},
+		{p, "alice", "HOME", reservedEnvRule},
+		{p, "alice", "FOO", "alice-env"},
+		{p, "bob", "PATH", reservedEnvRule},
+		{p, "bob", "FOO", ""},
+		{p, "bob", "SECRET_KEY", "no-secrets"},
+	} {
+		req := &pb.RunRequest{Cmd: "echo", Env: map[string]string{tc.env: "x"}}
+		if rule := violatedRule(t, tc.p.admit(tc.user, req)); rule != tc.rule {
+			t.Errorf("admit(%q) with %s set violated %q, want %q", tc.user, tc.env, rule, tc.rule)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dominichamon/sprinkle/internal"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+var (
+	peers registry
+
+	registrationTTL = flag.Duration("registration_ttl", 3*time.Minute, "How long a registration from another worker lasts before it must be renewed")
+)
+
+// peerCheckTimeout is how long a worker registering with this one has to answer a status check, which must fit
+// within the registering worker's own timeout.
+const peerCheckTimeout = 3 * time.Second
+
+// registry tracks the workers that have registered with this worker as a seed.
+type registry struct {
+	sync.Mutex
+	expiry map[string]time.Time
+}
+
+func init() {
+	peers.Lock()
+	peers.expiry = make(map[string]time.Time)
+	peers.Unlock()
+}
+
+func (r *registry) add(addr string) {
+	r.Lock()
+	r.expiry[addr] = time.Now().Add(*registrationTTL)
+	r.Unlock()
+}
+
+// list returns the addresses of all unexpired registrations.
+func (r *registry) list() []string {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	addrs := make([]string, 0, len(r.expiry))
+	for addr, expiry := range r.expiry {
+		if now.After(expiry) {
+			delete(r.expiry, addr)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// checkPeer confirms that a worker answers at addr, without presenting it this worker's token.
+func checkPeer(ctx context.Context, addr string) error {
+	w, err := internal.DialWorker(addr)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	ctx, cancel := context.WithTimeout(internal.WithoutToken(ctx), peerCheckTimeout)
+	defer cancel()
+	_, err = w.Client.Status(ctx, &pb.StatusRequest{})
+	return err
+}
+
+// Register adds a worker to those this worker gives out as peers, once it has checked that the worker answers at
+// the given address. Registrations expire unless renewed within registration_ttl.
+func (s *workerServer) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+	if req.Cluster != *cluster {
+		return nil, fmt.Errorf("worker is in cluster %q, not %q", *cluster, req.Cluster)
+	}
+	if _, _, err := net.SplitHostPort(req.Addr); err != nil {
+		return nil, fmt.Errorf("invalid addr %q: %s", req.Addr, err)
+	}
+	if err := checkPeer(ctx, req.Addr); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "no worker answers at %s: %s", req.Addr, err)
+	}
+	glog.Infof("registered peer %s", req.Addr)
+	peers.add(req.Addr)
+	return &pb.RegisterResponse{}, nil
+}
+
+func (s *workerServer) Peers(_ context.Context, req *pb.PeersRequest) (*pb.PeersResponse, error) {
+	if req.Cluster != *cluster {
+		return nil, fmt.Errorf("worker is in cluster %q, not %q", *cluster, req.Cluster)
+	}
+	return &pb.PeersResponse{Addr: peers.list()}, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+var (
+	sampleInterval = flag.Duration("sample_interval", 5*time.Second, "How often to sample the resources used by each running job. Jobs are not sampled if zero")
+	sampleKeep     = flag.Int("sample_keep", 120, "The number of resource samples to keep per job. When reached, every other sample is dropped and the job is sampled half as often")
+
+	errSamplingUnsupported = errors.New("sampling jobs is not supported on this platform")
+)
+
+// usage is the resources used by a job's processes.
+type usage struct {
+	processes  int32
+	rss        uint64
+	cpuSeconds float64
+	threads    int32
+	fds        int32
+	read       uint64
+	written    uint64
+}
+
+// jobSamples is a time series of the resources used by a job, which covers the job's whole run at decreasing
+// resolution as it gets longer.
+type jobSamples struct {
+	sync.Mutex
+	samples  []*pb.ResourceSample
+	interval time.Duration
+	done     chan struct{}
+}
+
+func newJobSamples() *jobSamples {
+	return &jobSamples{interval: *sampleInterval, done: make(chan struct{})}
+}
+
+func (s *jobSamples) add(r *pb.ResourceSample) {
+	s.Lock()
+	defer s.Unlock()
+	s.samples = append(s.samples, r)
+	if n := len(s.samples); n > 1 && n >= *sampleKeep {
+		// Keep every other sample, including the latest, in a new slice as earlier ones may still be read.
+		thinned := make([]*pb.ResourceSample, 0, n/2+1)
+		for i := (n - 1) % 2; i < n; i += 2 {
+			thinned = append(thinned, s.samples[i])
+		}
+		s.samples = thinned
+		s.interval *= 2
+	}
+}
+
+// all returns the samples, oldest first.
+func (s *jobSamples) all() []*pb.ResourceSample {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	return append([]*pb.ResourceSample(nil), s.samples...)
+}
+
+// latest returns the most recent sample, if any.
+func (s *jobSamples) latest() []*pb.ResourceSample {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	if len(s.samples) == 0 {
+		return nil
+	}
+	return []*pb.ResourceSample{s.samples[len(s.samples)-1]}
+}
+
+// stop ends sampling once the job completes.
+func (s *jobSamples) stop() {
+	if s != nil {
+		close(s.done)
+	}
+}
+
+// sample records the resources used by the processes of the job started at the given time in the process
+// group pgid, until the job completes.
+func (s *jobSamples) sample(pgid int, start time.Time) {
+	if *sampleInterval <= 0 {
+		return
+	}
+	prevTime, prevCPU := start, 0.0
+	for {
+		s.Lock()
+		interval := s.interval
+		s.Unlock()
+		select {
+		case <-s.done:
+			return
+		case <-time.After(interval):
+		}
+
+		u, err := sampleProcesses(pgid)
+		if errors.Is(err, errSamplingUnsupported) {
+			return
+		}
+		if err != nil {
+			glog.Warningf("failed to sample job %d: %s", pgid, err)
+			continue
+		}
+		now := time.Now()
+		r := &pb.ResourceSample{
+			Time:       now.Unix(),
+			Processes:  u.processes,
+			Rss:        u.rss,
+			Threads:    u.threads,
+			OpenFds:    u.fds,
+			ReadBytes:  u.read,
+			WriteBytes: u.written,
+		}
+		// CPU time is lost when processes exit without being waited for, so it may appear to go backwards.
+		if elapsed := now.Sub(prevTime).Seconds(); elapsed > 0 && u.cpuSeconds > prevCPU {
+			r.CpuPercent = (u.cpuSeconds - prevCPU) / elapsed * 100
+		}
+		prevTime, prevCPU = now, u.cpuSeconds
+		s.add(r)
+	}
+}
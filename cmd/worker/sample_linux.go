@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// clockTicks is the unit of CPU times in /proc, which Linux fixes at 100 per second for userspace.
+const clockTicks = 100
+
+// procStat is what is needed from /proc/[pid]/stat.
+type procStat struct {
+	ppid, pgrp int
+	// ticks is the CPU time used by the process and the children it has waited for.
+	ticks   uint64
+	threads int32
+	// rss is in pages.
+	rss uint64
+}
+
+func readStat(pid int) (procStat, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return procStat{}, err
+	}
+	// The command name may contain spaces and parentheses, so fields are counted from the last ')'.
+	i := strings.LastIndexByte(string(b), ')')
+	if i < 0 {
+		return procStat{}, fmt.Errorf("malformed stat for %d", pid)
+	}
+	f := strings.Fields(string(b[i+1:]))
+	if len(f) < 22 {
+		return procStat{}, fmt.Errorf("malformed stat for %d", pid)
+	}
+	n := func(i int) uint64 {
+		v, _ := strconv.ParseUint(f[i], 10, 64)
+		return v
+	}
+	// f[0] is field 3 of proc(5): state.
+	return procStat{
+		ppid:    int(n(1)),
+		pgrp:    int(n(2)),
+		ticks:   n(11) + n(12) + n(13) + n(14),
+		threads: int32(n(17)),
+		rss:     n(21),
+	}, nil
+}
+
+// readIO returns the bytes the process has read from and written to storage, if it may be read.
+func readIO(pid int) (uint64, uint64) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/io", pid))
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+	var read, written uint64
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		k, v, ok := strings.Cut(s.Text(), ": ")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "read_bytes":
+			read, _ = strconv.ParseUint(v, 10, 64)
+		case "write_bytes":
+			written, _ = strconv.ParseUint(v, 10, 64)
+		}
+	}
+	return read, written
+}
+
+// sampleProcesses sums the resources used by the processes in the process group pgid, and by their
+// descendants, which may have left it.
+func sampleProcesses(pgid int) (usage, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return usage{}, err
+	}
+	procs := make(map[int]procStat)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		// Processes may exit while being read.
+		if st, err := readStat(pid); err == nil {
+			procs[pid] = st
+		}
+	}
+
+	in := make(map[int]bool)
+	for pid, st := range procs {
+		if st.pgrp == pgid {
+			in[pid] = true
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for pid, st := range procs {
+			if !in[pid] && in[st.ppid] {
+				in[pid] = true
+				changed = true
+			}
+		}
+	}
+	if len(in) == 0 {
+		return usage{}, fmt.Errorf("no processes in group %d", pgid)
+	}
+
+	var u usage
+	var ticks uint64
+	page := uint64(os.Getpagesize())
+	for pid := range in {
+		st := procs[pid]
+		u.processes++
+		u.rss += st.rss * page
+		u.threads += st.threads
+		ticks += st.ticks
+		if fds, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid)); err == nil {
+			u.fds += int32(len(fds))
+		}
+		r, w := readIO(pid)
+		u.read += r
+		u.written += w
+	}
+	u.cpuSeconds = float64(ticks) / clockTicks
+	return u, nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// sampleProcesses is unsupported as it relies on /proc.
+func sampleProcesses(_ int) (usage, error) {
+	return usage{}, errSamplingUnsupported
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+func TestJobSamplesThin(t *testing.T) {
+	defer func(keep int) { *sampleKeep = keep }(*sampleKeep)
+	*sampleKeep = 4
+
+	s := &jobSamples{interval: time.Second}
+	times := func() []int64 {
+		var ts []int64
+		for _, r := range s.all() {
+			ts = append(ts, r.Time)
+		}
+		return ts
+	}
+	for i := int64(1); i <= 3; i++ {
+		s.add(&pb.ResourceSample{Time: i})
+	}
+	if got, want := times(), []int64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %v, want %v", got, want)
+	}
+	s.add(&pb.ResourceSample{Time: 4})
+	if got, want := times(), []int64{2, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %v after thinning, want %v", got, want)
+	}
+	if s.interval != 2*time.Second {
+		t.Errorf("got interval %s after thinning, want 2s", s.interval)
+	}
+	if got := s.latest(); len(got) != 1 || got[0].Time != 4 {
+		t.Errorf("got latest %v, want the sample at 4", got)
+	}
+}
+
+func TestSampleProcesses(t *testing.T) {
+	u, err := sampleProcesses(syscall.Getpgrp())
+	if errors.Is(err, errSamplingUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.processes < 1 || u.threads < 1 || u.rss == 0 || u.fds == 0 {
+		t.Errorf("got implausible usage for the test's process group: %+v", u)
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"encoding/base64"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -16,6 +18,9 @@ import (
 	"github.com/mackerelio/go-osstat/loadavg"
 	"github.com/mackerelio/go-osstat/memory"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 
 	pb "github.com/dominichamon/sprinkle/api/sprinkle"
 )
@@ -41,9 +46,22 @@ type job struct {
 	start time.Time
 	end   time.Time
 	// TODO: replace with reference to binary/job.. see golang/groupcache
-	cmd            *exec.Cmd
-	stdout, stderr string
-	complete       bool
+	cmd      *exec.Cmd
+	logs     *jobLogs
+	samples  *jobSamples
+	complete bool
+	// owner is the identity of the caller that submitted the job.
+	owner string
+	// dir is the job's working directory, removed once it completes.
+	dir string
+	// ram is the RAM reserved for the job.
+	ram uint64
+	// req is the request that started the job, without its environment variables, whose names are in envKeys.
+	req     *pb.RunRequest
+	envKeys []string
+	// submitted is when the job was submitted, and from is the address it was submitted from.
+	submitted time.Time
+	from      string
 }
 
 type workerServer struct {
@@ -73,7 +91,7 @@ func (s *workerServer) Status(_ context.Context, _ *pb.StatusRequest) (*pb.Statu
 		return nil, err
 	}
 
-	ip, err := internal.ExternalIP()
+	ip, err := advertisedIP()
 	if err != nil {
 		return nil, err
 	}
@@ -94,15 +112,37 @@ func (s *workerServer) Status(_ context.Context, _ *pb.StatusRequest) (*pb.Statu
 		TotalRam: total,
 		FreeRam:  avail,
 		Load:     load5,
+		Labels:   labels,
+		Version:  internal.Version,
+		Draining: drain.active(),
 	}, nil
 }
 
-func (s *workerServer) Run(_ context.Context, req *pb.RunRequest) (*pb.RunResponse, error) {
+func (s *workerServer) Run(ctx context.Context, req *pb.RunRequest) (*pb.RunResponse, error) {
+	submitted := time.Now()
+	if !drain.admit() {
+		jobsRejected.WithLabelValues("draining").Inc()
+		return nil, status.Error(codes.Unavailable, "worker is draining")
+	}
+	// Draining waits until the job is either running or rejected.
+	defer drain.admitted()
+	err := admission.admit(caller(ctx), req)
+	audit.admission(ctx, req, err)
+	if err != nil {
+		glog.Infof("rejecting %q from %q: %s", req.Cmd, caller(ctx), err)
+		jobsRejected.WithLabelValues("policy").Inc()
+		return nil, err
+	}
+	if req.DryRun {
+		return &pb.RunResponse{}, nil
+	}
+
 	_, fr, err := ram()
 	if err != nil {
 		return nil, fmt.Errorf("failed to determine free RAM: %s", err)
 	}
 	if req.Ram > fr {
+		jobsRejected.WithLabelValues("ram").Inc()
 		return nil, fmt.Errorf("not enough available RAM; %d vs %d", req.Ram, fr)
 	}
 	_, load5, err := load()
@@ -110,18 +150,52 @@ func (s *workerServer) Run(_ context.Context, req *pb.RunRequest) (*pb.RunRespon
 		return nil, fmt.Errorf("unable to determine load: %s", err)
 	}
 	if load5 > *loadLimit {
+		jobsRejected.WithLabelValues("load").Inc()
 		return nil, fmt.Errorf("under too high load: %.3f (limit: %.3f)", load5, *loadLimit)
 	}
 
+	for k := range req.Env {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid environment variable %q", k)
+		}
+	}
+
 	// TODO: enqueue the job for later processing to limit jobs per worker
 	// see: http://www.goldsborough.me/go/2020/12/06/12-24-24-non-blocking_parallelism_for_services_in_go/
 	j := job{
-		start: time.Now(),
+		start:     time.Now(),
+		owner:     caller(ctx),
+		ram:       req.Ram,
+		req:       proto.Clone(req).(*pb.RunRequest),
+		submitted: submitted,
+		from:      peerAddr(ctx),
+		logs:      newJobLogs(),
+		samples:   newJobSamples(),
 	}
+	for k := range req.Env {
+		j.envKeys = append(j.envKeys, k)
+	}
+	sort.Strings(j.envKeys)
+	j.req.Env = nil
 
 	scmd := []string{"sh", "-c", req.Cmd}
 	glog.Infof("Running command %q with args %+v", scmd[0], scmd[1:])
 	j.cmd = exec.Command(scmd[0], scmd[1:]...)
+	// Run in a process group so the whole job can be cancelled.
+	j.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	j.dir, err = isolate(j.cmd, j.owner)
+	if err != nil {
+		jobsRejected.WithLabelValues("isolation").Inc()
+		return nil, status.Errorf(codes.PermissionDenied, "unable to isolate job: %s", err)
+	}
+	if len(req.Env) != 0 {
+		if j.cmd.Env == nil {
+			j.cmd.Env = os.Environ()
+		}
+		for k, v := range req.Env {
+			j.cmd.Env = append(j.cmd.Env, k+"="+v)
+		}
+	}
 	stdout, err := j.cmd.StdoutPipe()
 	if err != nil {
 		glog.Warningf("Unable to attach to stdout for %q: %s", req.Cmd, err)
@@ -131,8 +205,13 @@ func (s *workerServer) Run(_ context.Context, req *pb.RunRequest) (*pb.RunRespon
 		glog.Warningf("Unable to attach to stderr for %q: %s", req.Cmd, err)
 	}
 	glog.Infof("Running %q", req.Cmd)
+	token := watch.token()
 	err = j.cmd.Start()
 	if err != nil {
+		if j.dir != "" {
+			os.RemoveAll(j.dir)
+		}
+		jobsRejected.WithLabelValues("start").Inc()
 		return nil, fmt.Errorf("failed to run %q: %q", req.Cmd, err)
 	}
 
@@ -140,31 +219,56 @@ func (s *workerServer) Run(_ context.Context, req *pb.RunRequest) (*pb.RunRespon
 	id := int64(j.cmd.Process.Pid)
 	jobs.jobs[id] = j
 	jobs.Unlock()
+	go j.samples.sample(int(id), j.start)
+
+	audit.jobStarted(id, j, req)
+	jobsStarted.Inc()
+	publishJob(pb.WatchEvent_TYPE_JOB_STARTED, id, j, "")
+
+	var timeout *time.Timer
+	if req.TimeoutSeconds > 0 {
+		timeout = time.AfterFunc(time.Duration(req.TimeoutSeconds)*time.Second, func() {
+			glog.Infof("job %d timed out after %ds", id, req.TimeoutSeconds)
+			audit.jobEvent("job_timeout", id, "", fmt.Sprintf("timed out after %ds", req.TimeoutSeconds))
+			jobs.RLock()
+			publishJob(pb.WatchEvent_TYPE_JOB_CANCELLED, id, jobs.jobs[id], "timeout")
+			jobs.RUnlock()
+			syscall.Kill(-int(id), syscall.SIGTERM)
+		})
+	}
 
 	go func() {
 		jobs.RLock()
 		j := jobs.jobs[id]
 		jobs.RUnlock()
 
-		out, err := ioutil.ReadAll(stdout)
-		if err != nil {
-			glog.Error(err)
-			j.stdout = fmt.Sprintf("[E] Failed to read stdout for %q: %s", req.Cmd, err)
-		} else {
-			j.stdout = string(out)
-		}
-
-		out, err = ioutil.ReadAll(stderr)
-		if err != nil {
-			glog.Error(err)
-			j.stderr = fmt.Sprintf("[E] Failed to read stderr for %q: %s", req.Cmd, err)
-		} else {
-			j.stderr = string(out)
+		// Output must be read fully before waiting for the command.
+		var wg sync.WaitGroup
+		read := func(t pb.LogType, r io.Reader) {
+			defer wg.Done()
+			if err := j.logs.read(t, r); err != nil {
+				glog.Error(err)
+				j.logs.add(t, fmt.Sprintf("[E] Failed to read %s for %q: %s\n", t, req.Cmd, err))
+			}
 		}
+		wg.Add(2)
+		go read(pb.LogType_STDOUT, stdout)
+		go read(pb.LogType_STDERR, stderr)
+		wg.Wait()
 
 		if err := j.cmd.Wait(); err != nil {
 			fmt.Println(err)
 		}
+		j.samples.stop()
+		if timeout != nil {
+			timeout.Stop()
+		}
+
+		if j.dir != "" {
+			if err := os.RemoveAll(j.dir); err != nil {
+				glog.Warningf("failed to remove job directory %q: %s", j.dir, err)
+			}
+		}
 
 		glog.Infof("Marking job %d as complete", id)
 		j.complete = true
@@ -173,19 +277,41 @@ func (s *workerServer) Run(_ context.Context, req *pb.RunRequest) (*pb.RunRespon
 		jobs.Lock()
 		jobs.jobs[id] = j
 		jobs.Unlock()
+		j.logs.finish()
+
+		audit.jobEnded(id, j)
+		jobCompleted(j)
+		publishJob(pb.WatchEvent_TYPE_JOB_FINISHED, id, j, "")
 	}()
 
-	return &pb.RunResponse{JobId: id}, nil
+	return &pb.RunResponse{JobId: id, WatchToken: token}, nil
 }
 
 func (s *workerServer) Job(_ context.Context, req *pb.JobRequest) (*pb.JobResponse, error) {
 	jobs.RLock()
-	job := jobs.jobs[req.Id]
+	job, ok := jobs.jobs[req.Id]
 	jobs.RUnlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "job %d not found", req.Id)
+	}
+	resp := jobResponse(req.Id, job)
+	resp.Samples = job.samples.all()
+	return resp, nil
+}
 
+// jobResponse describes a job, with only its latest resource sample.
+func jobResponse(id int64, job job) *pb.JobResponse {
 	resp := &pb.JobResponse{
-		StartTime: job.start.Unix(),
-		State:     pb.JobResponse_STATE_UNKNOWN,
+		Id:            id,
+		StartTime:     job.start.Unix(),
+		State:         pb.JobResponse_STATE_UNKNOWN,
+		Owner:         job.owner,
+		Request:       job.req,
+		EnvKeys:       job.envKeys,
+		Argv:          job.cmd.Args,
+		SubmitTime:    job.submitted.Unix(),
+		SubmittedFrom: job.from,
+		Samples:       job.samples.latest(),
 	}
 	// TODO: when jobs are queued: return pending here.
 	resp.State = pb.JobResponse_STATE_RUNNING
@@ -210,7 +336,39 @@ func (s *workerServer) Job(_ context.Context, req *pb.JobRequest) (*pb.JobRespon
 			}
 		}
 	}
-	return resp, nil
+	return resp
+}
+
+// accessJob returns the job with the given id if the caller may view its logs or cancel it.
+func accessJob(ctx context.Context, id int64) (job, error) {
+	jobs.RLock()
+	j, ok := jobs.jobs[id]
+	jobs.RUnlock()
+	if !ok {
+		return job{}, status.Errorf(codes.NotFound, "job %d not found", id)
+	}
+	if !auth.mayAccess(ctx, j.owner) {
+		return job{}, status.Errorf(codes.PermissionDenied, "job %d is owned by %q", id, j.owner)
+	}
+	return j, nil
+}
+
+func (s *workerServer) Cancel(ctx context.Context, req *pb.CancelRequest) (*pb.CancelResponse, error) {
+	j, err := accessJob(ctx, req.JobId)
+	if err != nil {
+		return nil, err
+	}
+	if j.complete {
+		return nil, status.Errorf(codes.FailedPrecondition, "job %d is already complete", req.JobId)
+	}
+
+	glog.Infof("%q cancelling job %d", caller(ctx), req.JobId)
+	audit.jobEvent("job_cancelled", req.JobId, caller(ctx), "")
+	publishJob(pb.WatchEvent_TYPE_JOB_CANCELLED, req.JobId, j, "cancelled")
+	if err := syscall.Kill(-j.cmd.Process.Pid, syscall.SIGTERM); err != nil {
+		return nil, fmt.Errorf("failed to cancel job %d: %s", req.JobId, err)
+	}
+	return &pb.CancelResponse{}, nil
 }
 
 func (s *workerServer) Jobs(_ context.Context, _ *pb.JobsRequest) (*pb.JobsResponse, error) {
@@ -227,50 +385,135 @@ func (s *workerServer) Jobs(_ context.Context, _ *pb.JobsRequest) (*pb.JobsRespo
 	return resp, nil
 }
 
-// streamLogs chunks up the `logs` of type `t`, and streams to `stream`.
-func streamLogs(stream pb.Worker_LogsServer, t pb.LogType, logs string) error {
-	glog.Infof("chunking %q", logs)
-	for _, s := range strings.Split(logs, "\n") {
-		err := stream.Send(&pb.LogsResponse{
-			Type:  t,
-			Chunk: s + "\n",
-		})
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// pageKey orders jobs by when they started, breaking ties by id, so that jobs started after a listing began
+// appear on its later pages.
+type pageKey struct {
+	start int64
+	id    int64
+}
+
+func (k pageKey) less(o pageKey) bool {
+	return k.start < o.start || k.start == o.start && k.id < o.id
+}
+
+func (k pageKey) token() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d/%d", k.start, k.id)))
+}
+
+func parsePageToken(token string) (pageKey, error) {
+	var k pageKey
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		_, err = fmt.Sscanf(string(b), "%d/%d", &k.start, &k.id)
+	}
+	if err != nil {
+		return k, status.Errorf(codes.InvalidArgument, "invalid page token %q", token)
+	}
+	return k, nil
+}
+
+// listed reports whether a job matches the filter of a ListJobs request.
+func listed(req *pb.ListJobsRequest, j *pb.JobResponse, labels map[string]string) bool {
+	if req.State != pb.JobResponse_STATE_UNKNOWN && j.State != req.State {
+		return false
+	}
+	if req.Owner != "" && j.Owner != req.Owner {
+		return false
+	}
+	if req.Since != 0 && j.State == pb.JobResponse_STATE_COMPLETE && j.EndTime < req.Since {
+		return false
+	}
+	return internal.Matches(labels, req.Labels)
+}
+
+func (s *workerServer) ListJobs(_ context.Context, req *pb.ListJobsRequest) (*pb.ListJobsResponse, error) {
+	size := int(req.PageSize)
+	switch {
+	case size < 0:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid page size %d", size)
+	case size == 0:
+		size = defaultPageSize
+	case size > maxPageSize:
+		size = maxPageSize
+	}
+	var after *pageKey
+	if req.PageToken != "" {
+		k, err := parsePageToken(req.PageToken)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		after = &k
+	}
+
+	type entry struct {
+		key pageKey
+		job *pb.JobResponse
+	}
+	var es []entry
+	jobs.RLock()
+	for id, j := range jobs.jobs {
+		k := pageKey{start: j.start.UnixNano(), id: id}
+		if after != nil && !after.less(k) {
+			continue
+		}
+		if jr := jobResponse(id, j); listed(req, jr, j.req.GetLabels()) {
+			es = append(es, entry{key: k, job: jr})
 		}
 	}
-	return nil
+	jobs.RUnlock()
+	sort.Slice(es, func(i, j int) bool { return es[i].key.less(es[j].key) })
+
+	resp := &pb.ListJobsResponse{}
+	if len(es) > size {
+		es = es[:size]
+		resp.NextPageToken = es[size-1].key.token()
+	}
+	for _, e := range es {
+		resp.Jobs = append(resp.Jobs, e.job)
+	}
+	return resp, nil
 }
 
 func (s *workerServer) Logs(req *pb.LogsRequest, stream pb.Worker_LogsServer) error {
-	var job job
-	for {
-		jobs.RLock()
-		var ok bool
-		job, ok = jobs.jobs[req.JobId]
-		if !ok {
-			return fmt.Errorf("job %d not found", req.JobId)
-		}
-		jobs.RUnlock()
+	job, err := accessJob(stream.Context(), req.JobId)
+	if err != nil {
+		return err
+	}
 
-		if job.complete {
-			break
+	next := int(req.Offset)
+	sent := int64(0)
+	for {
+		lines, done, changed := job.logs.since(next)
+		for i, l := range lines {
+			if req.Type != pb.LogType_BOTH && req.Type != l.t {
+				continue
+			}
+			if req.Limit != 0 && sent == req.Limit {
+				return nil
+			}
+			if err := stream.Send(&pb.LogsResponse{
+				Type:  l.t,
+				Chunk: l.text,
+				Line:  int64(next + i),
+			}); err != nil {
+				return err
+			}
+			sent++
 		}
-		// TODO: don't wait for the job to complete before streaming
-		// the logs.
-		glog.Infof("Waiting for job %d to complete", req.JobId)
-		time.Sleep(3 * time.Second)
-	}
+		next += len(lines)
 
-	if req.Type == pb.LogType_STDOUT || req.Type == pb.LogType_BOTH {
-		if err := streamLogs(stream, pb.LogType_STDOUT, job.stdout); err != nil {
-			return err
+		if done || req.NoWait {
+			return nil
 		}
-	}
-	if req.Type == pb.LogType_STDERR || req.Type == pb.LogType_BOTH {
-		if err := streamLogs(stream, pb.LogType_STDERR, job.stderr); err != nil {
-			return err
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
 		}
 	}
-	return nil
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+func TestListJobs(t *testing.T) {
+	done := exec.Command("true")
+	if err := done.Run(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1000, 0)
+
+	jobs.Lock()
+	old := jobs.jobs
+	jobs.jobs = map[int64]job{
+		// Listed in order of start time, not id.
+		5: {start: start, end: start.Add(10 * time.Second), cmd: done, owner: "alice"},
+		4: {start: start.Add(time.Second), end: start.Add(100 * time.Second), cmd: done, owner: "bob"},
+		3: {start: start.Add(2 * time.Second), cmd: &exec.Cmd{}, owner: "alice", req: &pb.RunRequest{Labels: map[string]string{"team": "a"}}},
+		2: {start: start.Add(3 * time.Second), cmd: &exec.Cmd{}, owner: "bob", req: &pb.RunRequest{Labels: map[string]string{"team": "b"}}},
+		1: {start: start.Add(3 * time.Second), cmd: &exec.Cmd{}, owner: "alice"},
+	}
+	jobs.Unlock()
+	defer func() {
+		jobs.Lock()
+		jobs.jobs = old
+		jobs.Unlock()
+	}()
+
+	s := &workerServer{}
+	list := func(req *pb.ListJobsRequest) []int64 {
+		t.Helper()
+		var ids []int64
+		for {
+			resp, err := s.ListJobs(context.Background(), req)
+			if err != nil {
+				t.Fatalf("ListJobs(%v): %s", req, err)
+			}
+			for _, j := range resp.Jobs {
+				ids = append(ids, j.Id)
+			}
+			if resp.NextPageToken == "" {
+				return ids
+			}
+			req.PageToken = resp.NextPageToken
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		req  *pb.ListJobsRequest
+		want []int64
+	}{
+		{"all", &pb.ListJobsRequest{}, []int64{5, 4, 3, 1, 2}},
+		{"paged", &pb.ListJobsRequest{PageSize: 2}, []int64{5, 4, 3, 1, 2}},
+		{"state", &pb.ListJobsRequest{State: pb.JobResponse_STATE_COMPLETE}, []int64{5, 4}},
+		{"owner", &pb.ListJobsRequest{Owner: "alice", PageSize: 1}, []int64{5, 3, 1}},
+		{"since", &pb.ListJobsRequest{Since: 1050}, []int64{4, 3, 1, 2}},
+		{"label", &pb.ListJobsRequest{Labels: map[string]string{"team": ""}}, []int64{3, 2}},
+		{"label value", &pb.ListJobsRequest{Labels: map[string]string{"team": "b"}}, []int64{2}},
+	} {
+		if got := list(tc.req); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got jobs %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := s.ListJobs(context.Background(), &pb.ListJobsRequest{PageToken: "bogus"}); err == nil {
+		t.Error("ListJobs with a bad page token succeeded")
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+var (
+	watchBacklog  = flag.Int("watch_backlog", 1000, "The number of recent events kept for watchers to resume from")
+	watchInterval = flag.Duration("watch_interval", 5*time.Second, "How often to check free RAM and load against their thresholds for watchers")
+	lowRAM        = flag.Float64("low_ram", 0.1, "The fraction of total RAM below which free RAM is reported to watchers as over its threshold")
+
+	watch watchHub
+
+	errShuttingDown = status.Error(codes.Unavailable, "worker is shutting down")
+)
+
+// watchSubscriberBuffer is how many events a watcher may fall behind by before it is dropped.
+const watchSubscriberBuffer = 64
+
+// watchHub numbers events, keeps the most recent for watchers to resume from, and fans them out to watchers.
+type watchHub struct {
+	sync.Mutex
+	// boot distinguishes this run of the worker's tokens from those of earlier runs.
+	boot    string
+	seq     uint64
+	backlog []*pb.WatchEvent
+	subs    map[chan *pb.WatchEvent]bool
+	// closed is set once the worker is shutting down, after which there are no more events.
+	closed bool
+}
+
+func init() {
+	watch.Lock()
+	watch.boot = strconv.FormatInt(time.Now().UnixNano(), 36)
+	watch.subs = make(map[chan *pb.WatchEvent]bool)
+	watch.Unlock()
+}
+
+// setupWatch checks the flags that configure watching.
+func setupWatch() error {
+	if *watchBacklog < 0 {
+		return fmt.Errorf("watch_backlog must not be negative")
+	}
+	return nil
+}
+
+func watchToken(boot string, seq uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s/%d", boot, seq)))
+}
+
+func parseWatchToken(token string) (string, uint64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		for i := len(b) - 1; i >= 0; i-- {
+			if b[i] == '/' {
+				seq, err := strconv.ParseUint(string(b[i+1:]), 10, 64)
+				if err != nil {
+					break
+				}
+				return string(b[:i]), seq, nil
+			}
+		}
+	}
+	return "", 0, status.Errorf(codes.InvalidArgument, "invalid resume token %q", token)
+}
+
+// token returns a resume token from which to watch events published after now.
+func (h *watchHub) token() string {
+	h.Lock()
+	defer h.Unlock()
+	return watchToken(h.boot, h.seq)
+}
+
+// publish sends an event to all watchers, dropping those that have fallen too far behind.
+func (h *watchHub) publish(e *pb.WatchEvent) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.seq++
+	e.Token = watchToken(h.boot, h.seq)
+	e.Time = time.Now().Unix()
+	h.backlog = append(h.backlog, e)
+	if n := len(h.backlog) - *watchBacklog; n > 0 {
+		h.backlog = append([]*pb.WatchEvent(nil), h.backlog[n:]...)
+	}
+
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel of the events published from now on, and the events already published after the
+// given resume token, if any. The channel is closed if the watcher falls behind.
+func (h *watchHub) subscribe(token string) (chan *pb.WatchEvent, []*pb.WatchEvent, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.closed {
+		return nil, nil, errShuttingDown
+	}
+	var backlog []*pb.WatchEvent
+	if token != "" {
+		boot, seq, err := parseWatchToken(token)
+		if err != nil {
+			return nil, nil, err
+		}
+		if boot != h.boot || seq > h.seq {
+			return nil, nil, status.Error(codes.OutOfRange, "resume token is from an earlier run of the worker")
+		}
+		missed := h.seq - seq
+		if missed > uint64(len(h.backlog)) {
+			return nil, nil, status.Errorf(codes.OutOfRange, "resume token has expired: %d events have been missed", missed)
+		}
+		backlog = append(backlog, h.backlog[uint64(len(h.backlog))-missed:]...)
+	}
+
+	ch := make(chan *pb.WatchEvent, watchSubscriberBuffer)
+	h.subs[ch] = true
+	return ch, backlog, nil
+}
+
+func (h *watchHub) unsubscribe(ch chan *pb.WatchEvent) {
+	h.Lock()
+	defer h.Unlock()
+	if h.subs[ch] {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// close disconnects all watchers as the worker shuts down.
+func (h *watchHub) close() {
+	h.Lock()
+	defer h.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// publishJob sends an event about a job to watchers.
+func publishJob(t pb.WatchEvent_Type, id int64, j job, reason string) {
+	watch.publish(&pb.WatchEvent{Type: t, Job: jobResponse(id, j), Reason: reason})
+}
+
+// watchResources periodically checks free RAM and load, and sends an event to watchers whenever either crosses
+// its threshold.
+func watchResources() {
+	over := make(map[string]bool)
+	for range time.Tick(*watchInterval) {
+		st, err := (&workerServer{}).Status(context.Background(), &pb.StatusRequest{})
+		if err != nil {
+			glog.Warningf("failed to check resources: %s", err)
+			continue
+		}
+		for _, r := range []struct {
+			name     string
+			exceeded bool
+		}{
+			{"ram", float64(st.FreeRam) < *lowRAM*float64(st.TotalRam)},
+			{"load", st.Load > *loadLimit},
+		} {
+			if r.exceeded == over[r.name] {
+				continue
+			}
+			over[r.name] = r.exceeded
+			glog.Infof("%s over threshold: %t", r.name, r.exceeded)
+			watch.publish(&pb.WatchEvent{
+				Type:     pb.WatchEvent_TYPE_RESOURCE_THRESHOLD,
+				Reason:   r.name,
+				Status:   st,
+				Exceeded: r.exceeded,
+			})
+		}
+	}
+}
+
+func (s *workerServer) Watch(req *pb.WatchRequest, stream pb.Worker_WatchServer) error {
+	ch, backlog, err := watch.subscribe(req.ResumeToken)
+	if err != nil {
+		return err
+	}
+	defer watch.unsubscribe(ch)
+
+	send := func(e *pb.WatchEvent) error {
+		if req.JobId != 0 && e.Job.GetId() != req.JobId {
+			return nil
+		}
+		return stream.Send(e)
+	}
+	for _, e := range backlog {
+		if err := send(e); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e, ok := <-ch:
+			if !ok {
+				watch.Lock()
+				closed := watch.closed
+				watch.Unlock()
+				if closed {
+					return errShuttingDown
+				}
+				return status.Error(codes.ResourceExhausted, "fell too far behind; resume from the last event received")
+			}
+			if err := send(e); err != nil {
+				return err
+			}
+		}
+	}
+}
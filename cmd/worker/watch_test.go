@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+func TestWatchResume(t *testing.T) {
+	*watchBacklog = 2
+	defer func() { *watchBacklog = 1000 }()
+
+	start := watch.token()
+	for i := int64(1); i <= 3; i++ {
+		watch.publish(&pb.WatchEvent{Job: &pb.JobResponse{Id: i}})
+	}
+
+	if _, _, err := watch.subscribe(start); status.Code(err) != codes.OutOfRange {
+		t.Errorf("resuming from an expired token: got %v, want OutOfRange", err)
+	}
+	if _, _, err := watch.subscribe(watchToken("earlier", 1)); status.Code(err) != codes.OutOfRange {
+		t.Errorf("resuming from an earlier run: got %v, want OutOfRange", err)
+	}
+	if _, _, err := watch.subscribe("bogus"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("resuming from a bad token: got %v, want InvalidArgument", err)
+	}
+
+	ch, backlog, err := watch.subscribe(watchToken(watch.boot, watch.seq-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watch.unsubscribe(ch)
+	if len(backlog) != 1 || backlog[0].Job.Id != 3 {
+		t.Errorf("got backlog %v, want job 3", backlog)
+	}
+
+	watch.publish(&pb.WatchEvent{Job: &pb.JobResponse{Id: 4}})
+	if e := <-ch; e.Job.Id != 4 {
+		t.Errorf("got event for job %d, want 4", e.Job.Id)
+	}
+	ch2, _, err := watch.subscribe(backlog[0].Token)
+	if err != nil {
+		t.Fatalf("resuming from the last event: %s", err)
+	}
+	watch.unsubscribe(ch2)
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// DefaultCluster is the cluster used when none is specified.
+const DefaultCluster = "default"
+
+// MaxClockSkew is how far a signed message's timestamp may be from the local
+// clock before it is rejected. Nonces are remembered for twice this long.
+const MaxClockSkew = 30 * time.Second
+
+// Message is the payload of both discovery pings and acks. For pings, Addr is
+// the address on which the sender is listening for acks. For acks, Addr is the
+// address of the worker's RPC service.
+type Message struct {
+	Cluster string `json:"cluster"`
+	Addr    string `json:"addr"`
+	Time    int64  `json:"time"`
+	Nonce   string `json:"nonce"`
+	MAC     string `json:"mac,omitempty"`
+}
+
+// Codec encodes and decodes discovery messages for a single cluster. If it has
+// a key, messages are signed with an HMAC and unsigned, forged or replayed
+// messages are rejected.
+type Codec struct {
+	cluster string
+	key     []byte
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewCodec returns a codec for the given cluster. A nil or empty key disables
+// authentication.
+func NewCodec(cluster string, key []byte) *Codec {
+	return &Codec{
+		cluster: cluster,
+		key:     key,
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// LoadKey reads a shared discovery secret from path, ignoring surrounding
+// whitespace. An empty path returns a nil key.
+func LoadKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(b)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("discovery key file %q is empty", path)
+	}
+	return key, nil
+}
+
+func (c *Codec) mac(m Message) (string, error) {
+	m.MAC = ""
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, c.key)
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Encode serializes a discovery message carrying addr, signing it if the codec
+// has a key.
+func (c *Codec) Encode(addr string) ([]byte, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	m := Message{
+		Cluster: c.cluster,
+		Addr:    addr,
+		Time:    time.Now().UnixNano(),
+		Nonce:   hex.EncodeToString(nonce),
+	}
+	if len(c.key) != 0 {
+		mac, err := c.mac(m)
+		if err != nil {
+			return nil, err
+		}
+		m.MAC = mac
+	}
+	return json.Marshal(m)
+}
+
+// Decode parses a discovery message, returning an error if it does not belong
+// to the codec's cluster or, when the codec has a key, if it fails
+// authentication.
+func (c *Codec) Decode(b []byte) (Message, error) {
+	var m Message
+	if err := json.Unmarshal(b, &m); err != nil {
+		return Message{}, fmt.Errorf("malformed discovery message: %s", err)
+	}
+	if m.Cluster != c.cluster {
+		return Message{}, fmt.Errorf("discovery message for cluster %q (expected %q)", m.Cluster, c.cluster)
+	}
+	if m.Addr == "" {
+		return Message{}, errors.New("discovery message has no addr")
+	}
+	if len(c.key) == 0 {
+		return m, nil
+	}
+
+	if m.MAC == "" {
+		return Message{}, errors.New("unsigned discovery message")
+	}
+	mac, err := c.mac(m)
+	if err != nil {
+		return Message{}, err
+	}
+	if !hmac.Equal([]byte(mac), []byte(m.MAC)) {
+		return Message{}, errors.New("discovery message has invalid signature")
+	}
+
+	now := time.Now()
+	sent := time.Unix(0, m.Time)
+	if sent.Before(now.Add(-MaxClockSkew)) || sent.After(now.Add(MaxClockSkew)) {
+		return Message{}, fmt.Errorf("discovery message timestamp %s outside allowed skew", sent)
+	}
+	if m.Nonce == "" {
+		return Message{}, errors.New("discovery message has no nonce")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n, expiry := range c.seen {
+		if now.After(expiry) {
+			delete(c.seen, n)
+		}
+	}
+	if _, ok := c.seen[m.Nonce]; ok {
+		return Message{}, fmt.Errorf("replayed discovery message (nonce %s)", m.Nonce)
+	}
+	c.seen[m.Nonce] = now.Add(2 * MaxClockSkew)
+	return m, nil
+}
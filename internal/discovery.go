@@ -1,94 +1,334 @@
 package internal
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
 )
 
-// Ping sends out a multicast message to the given address and port and sends any responses to the given channel.
-func Ping(addr string, port int, addrs chan<- string) error {
-	// Sanity checks
-	if addr == "" {
-		return errors.New("expected valid addr")
+// Mechanisms by which clients can discover workers, in addition to seeds.
+const (
+	MechanismMulticast = "multicast"
+	MechanismMDNS      = "mdns"
+)
+
+// DefaultDiscoveryTimeout is how long discovery waits for workers to respond if no timeout is set.
+const DefaultDiscoveryTimeout = 5 * time.Second
+
+// ParseMechanisms parses a comma-separated list of discovery mechanisms.
+func ParseMechanisms(s string) (map[string]bool, error) {
+	ms := make(map[string]bool)
+	for _, m := range strings.Split(s, ",") {
+		switch m = strings.TrimSpace(m); m {
+		case "":
+		case MechanismMulticast, MechanismMDNS:
+			ms[m] = true
+		default:
+			return nil, fmt.Errorf("unknown discovery mechanism %q", m)
+		}
 	}
+	return ms, nil
+}
 
-	udpaddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return err
+// Sources of discovered workers.
+const (
+	SourcePing   = "ping"
+	SourceMDNS   = "mdns"
+	SourceSeed   = "seed"
+	SourceGossip = "gossip"
+)
+
+// WorkerInfo describes a discovered worker.
+type WorkerInfo struct {
+	// Addr is the host:port address of the worker's RPC service.
+	Addr string
+	// Cluster is the cluster the worker belongs to.
+	Cluster string
+	// Source is how the worker was found.
+	Source string
+	// Labels and Version are only known for some sources.
+	Labels  map[string]string
+	Version string
+}
+
+// DiscoverOptions configures a single discovery.
+type DiscoverOptions struct {
+	// Timeout is how long to wait for workers to respond. Defaults to DefaultDiscoveryTimeout.
+	Timeout time.Duration
+	// Limit, if positive, ends discovery as soon as this many distinct workers have been found.
+	Limit int
+}
+
+func (o DiscoverOptions) timeout() time.Duration {
+	if o.Timeout <= 0 {
+		return DefaultDiscoveryTimeout
 	}
+	return o.Timeout
+}
 
-	if !udpaddr.IP.IsMulticast() {
-		return fmt.Errorf("%q is not multicast", addr)
+// Discoverer finds workers.
+type Discoverer interface {
+	// Discover looks for workers until the timeout expires, the limit is reached or ctx is done, and returns each
+	// distinct worker found by then. An error means discovery could not be performed at all.
+	Discover(ctx context.Context, opts DiscoverOptions) ([]WorkerInfo, error)
+}
+
+// found accumulates distinct workers, up to a limit.
+type found struct {
+	limit   int
+	workers []WorkerInfo
+	index   map[string]int
+}
+
+func newFound(limit int) *found {
+	return &found{limit: limit, index: make(map[string]int)}
+}
+
+// add records w, filling in anything unknown about an earlier record of the same worker, and reports whether the
+// limit has been reached.
+func (f *found) add(w WorkerInfo) bool {
+	if i, ok := f.index[w.Addr]; ok {
+		prev := &f.workers[i]
+		if prev.Cluster == "" {
+			prev.Cluster = w.Cluster
+		}
+		if prev.Labels == nil {
+			prev.Labels = w.Labels
+		}
+		if prev.Version == "" {
+			prev.Version = w.Version
+		}
+		return f.full()
+	}
+	if f.full() {
+		return true
 	}
+	f.index[w.Addr] = len(f.workers)
+	f.workers = append(f.workers, w)
+	return f.full()
+}
+
+func (f *found) full() bool {
+	return f.limit > 0 && len(f.workers) >= f.limit
+}
+
+// Announcer makes a worker discoverable.
+type Announcer interface {
+	// Announce starts making the worker with the RPC address addr discoverable.
+	Announce(addr string) error
+	// Close stops announcing the worker.
+	Close() error
+}
+
+// PacketConn is a datagram connection that a Transport listens on.
+type PacketConn interface {
+	Read(b []byte) (int, error)
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// Transport carries discovery pings to a group of workers and acks back to the sender.
+type Transport interface {
+	// ListenGroup returns a connection that receives datagrams sent to the group.
+	ListenGroup() (PacketConn, error)
+	// Listen returns a connection that receives datagrams sent to the returned address.
+	Listen() (PacketConn, string, error)
+	// SendGroup sends a datagram to every member of the group.
+	SendGroup(b []byte) error
+	// Send sends a datagram to addr.
+	Send(addr string, b []byte) error
+}
 
-	// Listen first.
-	laddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
+// Pinger discovers workers by sending a ping over a transport and collecting the acks.
+type Pinger struct {
+	Transport Transport
+	// Codec encodes pings and decodes acks.
+	Codec *Codec
+}
+
+// Discover implements Discoverer.
+func (p *Pinger) Discover(ctx context.Context, opts DiscoverOptions) ([]WorkerInfo, error) {
+	c, raddr, err := p.Transport.Listen()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer c.Close()
 
-	c, err := net.ListenUDP("udp", laddr)
+	glog.Infof("discovery listening on %s", raddr)
+
+	msg, err := p.Codec.Encode(raddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	glog.Infof("discovery listening on %s", laddr)
-
-	var done bool
+	deadline := time.Now().Add(opts.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := c.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
 
-	// Stop the discovery scan after 5 seconds.
+	// Unblock the read below if the context is done first.
+	stop := make(chan struct{})
+	defer close(stop)
 	go func() {
-		tick := time.NewTicker(5 * time.Second)
 		select {
-		case <-tick.C:
-			glog.Info("discovery timeout")
-			done = true
-			tick.Stop()
+		case <-ctx.Done():
+			c.Close()
+		case <-stop:
 		}
 	}()
 
+	// Send out a ping.
+	glog.Infof("sending msg %q", msg)
+	if err := p.Transport.SendGroup(msg); err != nil {
+		return nil, err
+	}
+
 	// Check for acks.
+	f := newFound(opts.Limit)
+	for !f.full() {
+		b := make([]byte, 1024)
+		n, err := c.Read(b)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				glog.Info("discovery timeout")
+			} else if ctx.Err() == nil {
+				glog.Error(err)
+			}
+			break
+		}
+
+		glog.Infof("discovery ack %s [%d]", b[:n], n)
+
+		ack, err := p.Codec.Decode(b[:n])
+		if err != nil {
+			glog.Warningf("ignoring discovery ack: %s", err)
+			continue
+		}
+
+		f.add(WorkerInfo{Addr: ack.Addr, Cluster: ack.Cluster, Source: SourcePing})
+	}
+	return f.workers, nil
+}
+
+// Responder announces a worker by answering pings received over a transport.
+type Responder struct {
+	Transport Transport
+	// Codec decodes pings and encodes acks.
+	Codec *Codec
+	// OnPing, if set, is called for every ping received with whether it was answered.
+	OnPing func(answered bool)
+
+	conn PacketConn
+}
+
+// Announce implements Announcer.
+func (r *Responder) Announce(addr string) error {
+	c, err := r.Transport.ListenGroup()
+	if err != nil {
+		return err
+	}
+	r.conn = c
+
 	go func() {
-		for !done {
+		for {
 			b := make([]byte, 1024)
-			c.SetReadDeadline(time.Now().Add(1 * time.Second))
 			n, err := c.Read(b)
 			if err != nil {
-				if !err.(net.Error).Timeout() {
+				if !errors.Is(err, net.ErrClosed) {
 					glog.Error(err)
 				}
 				break
 			}
-			s := string(b[:n])
+			glog.Infof("discovery ping %s [%d]", b[:n], n)
 
-			glog.Infof("discovery ack %s [%d]", s, n)
+			m, err := r.Codec.Decode(b[:n])
+			if r.OnPing != nil {
+				r.OnPing(err == nil)
+			}
+			if err != nil {
+				glog.Warningf("ignoring discovery ping: %s", err)
+				continue
+			}
+
+			// Reply!
+			ack, err := r.Codec.Encode(addr)
+			if err != nil {
+				glog.Error(err)
+				continue
+			}
 
-			addrs <- s
+			if err := r.Transport.Send(m.Addr, ack); err != nil {
+				glog.Error(err)
+				continue
+			}
 		}
 		c.Close()
-		close(addrs)
 	}()
+	return nil
+}
 
-	// Send out a ping.
-	glog.Info("sending discovery ping on ", udpaddr)
+// Close implements Announcer.
+func (r *Responder) Close() error {
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.Close()
+}
 
-	pc, err := net.DialUDP("udp", nil, udpaddr)
-	if err != nil {
-		return err
+// Merge returns a Discoverer that discovers workers using all of ds concurrently. It fails only if all of ds fail.
+func Merge(ds ...Discoverer) Discoverer {
+	return merged(ds)
+}
+
+type merged []Discoverer
+
+func (ds merged) Discover(ctx context.Context, opts DiscoverOptions) ([]WorkerInfo, error) {
+	if len(ds) == 0 {
+		return nil, errors.New("expected a discovery mechanism or seeds")
 	}
-	defer pc.Close()
 
-	ip, err := ExternalIP()
-	if err != nil {
-		return err
+	// Stop the remaining discoverers once the limit is reached.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		workers []WorkerInfo
+		err     error
+	}
+	results := make(chan result, len(ds))
+	for _, d := range ds {
+		go func(d Discoverer) {
+			ws, err := d.Discover(ctx, opts)
+			results <- result{ws, err}
+		}(d)
 	}
 
-	msg := net.JoinHostPort(ip.String(), fmt.Sprintf("%d", port))
-	glog.Infof("sending msg %q", msg)
-	_, err = pc.Write([]byte(msg))
-	return err
+	f := newFound(opts.Limit)
+	var errs []string
+	for range ds {
+		r := <-results
+		if r.err != nil {
+			glog.Warningf("discovery failed: %s", r.err)
+			errs = append(errs, r.err.Error())
+			continue
+		}
+		for _, w := range r.workers {
+			if f.add(w) {
+				cancel()
+			}
+		}
+	}
+
+	if len(errs) == len(ds) {
+		return nil, fmt.Errorf("all discovery failed: %s", strings.Join(errs, "; "))
+	}
+	return f.workers, nil
 }
@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+const testTimeout = 200 * time.Millisecond
+
+// collect runs d and returns the sorted addresses it finds.
+func collect(t *testing.T, d Discoverer, opts DiscoverOptions) []string {
+	t.Helper()
+	if opts.Timeout == 0 {
+		opts.Timeout = testTimeout
+	}
+	ws, err := d.Discover(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Discover: %s", err)
+	}
+
+	var found []string
+	for _, w := range ws {
+		found = append(found, w.Addr)
+	}
+	sort.Strings(found)
+	return found
+}
+
+func announce(t *testing.T, a Announcer, addr string) {
+	t.Helper()
+	if err := a.Announce(addr); err != nil {
+		t.Fatalf("Announce: %s", err)
+	}
+	t.Cleanup(func() { a.Close() })
+}
+
+// fakeResponder answers the first ping on n that codec accepts with each of acks, verbatim.
+func fakeResponder(t *testing.T, n *MemoryNetwork, codec *Codec, acks ...[]byte) {
+	t.Helper()
+	c, err := n.ListenGroup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer c.Close()
+		b := make([]byte, 1024)
+		k, err := c.Read(b)
+		if err != nil {
+			return
+		}
+		m, err := codec.Decode(b[:k])
+		if err != nil {
+			t.Errorf("fake responder: %s", err)
+			return
+		}
+		for _, ack := range acks {
+			n.Send(m.Addr, ack)
+		}
+	}()
+}
+
+func encode(t *testing.T, c *Codec, addr string) []byte {
+	t.Helper()
+	b, err := c.Encode(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestPingerFindsResponders(t *testing.T) {
+	n := NewMemoryNetwork()
+	announce(t, &Responder{Transport: n, Codec: NewCodec("c", nil)}, "a:1")
+	announce(t, &Responder{Transport: n, Codec: NewCodec("c", nil)}, "b:1")
+
+	got := collect(t, &Pinger{Transport: n, Codec: NewCodec("c", nil)}, DiscoverOptions{})
+	if want := []string{"a:1", "b:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPingerTimeout(t *testing.T) {
+	n := NewMemoryNetwork()
+
+	start := time.Now()
+	got := collect(t, &Pinger{Transport: n, Codec: NewCodec("c", nil)}, DiscoverOptions{})
+	if len(got) != 0 {
+		t.Errorf("got %v, want nothing", got)
+	}
+	if d := time.Since(start); d > 2*testTimeout {
+		t.Errorf("discovery took %s, want at most %s", d, 2*testTimeout)
+	}
+}
+
+func TestPingerLimit(t *testing.T) {
+	n := NewMemoryNetwork()
+	for _, addr := range []string{"a:1", "b:1", "c:1"} {
+		announce(t, &Responder{Transport: n, Codec: NewCodec("c", nil)}, addr)
+	}
+
+	start := time.Now()
+	got := collect(t, &Pinger{Transport: n, Codec: NewCodec("c", nil)}, DiscoverOptions{Timeout: time.Minute, Limit: 2})
+	if len(got) != 2 {
+		t.Errorf("got %v, want 2 workers", got)
+	}
+	if d := time.Since(start); d > testTimeout {
+		t.Errorf("discovery took %s after reaching the limit", d)
+	}
+}
+
+func TestPingerCancel(t *testing.T) {
+	n := NewMemoryNetwork()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(testTimeout/4, cancel)
+
+	start := time.Now()
+	p := &Pinger{Transport: n, Codec: NewCodec("c", nil)}
+	if _, err := p.Discover(ctx, DiscoverOptions{Timeout: time.Minute}); err != nil {
+		t.Fatalf("Discover: %s", err)
+	}
+	if d := time.Since(start); d > testTimeout {
+		t.Errorf("discovery took %s after cancellation", d)
+	}
+}
+
+func TestPingerUsesEphemeralPorts(t *testing.T) {
+	n := NewMemoryNetwork()
+	announce(t, &Responder{Transport: n, Codec: NewCodec("c", nil)}, "a:1")
+
+	// Concurrent discoveries must not collide.
+	results := make(chan []string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			results <- collect(t, &Pinger{Transport: n, Codec: NewCodec("c", nil)}, DiscoverOptions{})
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if got, want := <-results, []string{"a:1"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPingerIgnoresDuplicateAcks(t *testing.T) {
+	n := NewMemoryNetwork()
+	codec := NewCodec("c", nil)
+	fakeResponder(t, n, codec, encode(t, codec, "a:1"), encode(t, codec, "a:1"), encode(t, codec, "b:1"))
+
+	got := collect(t, &Pinger{Transport: n, Codec: codec}, DiscoverOptions{})
+	if want := []string{"a:1", "b:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPingerIgnoresMalformedAcks(t *testing.T) {
+	n := NewMemoryNetwork()
+	codec := NewCodec("c", nil)
+	fakeResponder(t, n, codec,
+		[]byte("not json"),
+		[]byte(`{"cluster":"c"}`),
+		encode(t, NewCodec("other", nil), "other:1"),
+		encode(t, codec, "a:1"))
+
+	got := collect(t, &Pinger{Transport: n, Codec: codec}, DiscoverOptions{})
+	if want := []string{"a:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestResponderIgnoresMalformedPings(t *testing.T) {
+	n := NewMemoryNetwork()
+	codec := NewCodec("c", nil)
+	announce(t, &Responder{Transport: n, Codec: codec}, "a:1")
+
+	c, raddr, err := n.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	n.SendGroup([]byte("not json"))
+	n.SendGroup(encode(t, NewCodec("other", nil), raddr))
+
+	b := make([]byte, 1024)
+	c.SetReadDeadline(time.Now().Add(testTimeout))
+	if k, err := c.Read(b); err == nil {
+		t.Fatalf("got ack %s to malformed ping", b[:k])
+	}
+
+	n.SendGroup(encode(t, codec, raddr))
+	c.SetReadDeadline(time.Now().Add(testTimeout))
+	k, err := c.Read(b)
+	if err != nil {
+		t.Fatalf("no ack to valid ping: %s", err)
+	}
+	if m, err := codec.Decode(b[:k]); err != nil || m.Addr != "a:1" {
+		t.Errorf("got ack %+v, %v; want a:1", m, err)
+	}
+}
+
+func TestSignedDiscovery(t *testing.T) {
+	n := NewMemoryNetwork()
+	key := []byte("secret")
+	announce(t, &Responder{Transport: n, Codec: NewCodec("c", key)}, "signed:1")
+	announce(t, &Responder{Transport: n, Codec: NewCodec("c", nil)}, "unsigned:1")
+	announce(t, &Responder{Transport: n, Codec: NewCodec("c", []byte("wrong"))}, "wrong:1")
+
+	got := collect(t, &Pinger{Transport: n, Codec: NewCodec("c", key)}, DiscoverOptions{})
+	if want := []string{"signed:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCodecRejectsReplay(t *testing.T) {
+	sender, receiver := NewCodec("c", []byte("secret")), NewCodec("c", []byte("secret"))
+	b := encode(t, sender, "a:1")
+
+	if _, err := receiver.Decode(b); err != nil {
+		t.Fatalf("first Decode: %s", err)
+	}
+	if _, err := receiver.Decode(b); err == nil {
+		t.Error("replayed message was accepted")
+	}
+}
+
+func TestMergeDeduplicates(t *testing.T) {
+	n := NewMemoryNetwork()
+	announce(t, &Responder{Transport: n, Codec: NewCodec("c", nil)}, "a:1")
+
+	m := NewMemoryNetwork()
+	announce(t, &Responder{Transport: m, Codec: NewCodec("c", nil)}, "a:1")
+	announce(t, &Responder{Transport: m, Codec: NewCodec("c", nil)}, "b:1")
+
+	got := collect(t, Merge(
+		&Pinger{Transport: n, Codec: NewCodec("c", nil)},
+		&Pinger{Transport: m, Codec: NewCodec("c", nil)}), DiscoverOptions{})
+	if want := []string{"a:1", "b:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
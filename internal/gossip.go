@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hashicorp/memberlist"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+// gossipRetention is how long departed members are still reported.
+const gossipRetention = 10 * time.Minute
+
+// GossipConfig configures a worker's membership in a gossip cluster.
+type GossipConfig struct {
+	// Addr is the host:port of the worker's RPC service. It names the member.
+	Addr string
+	// BindPort is the UDP and TCP port on which to gossip.
+	BindPort int
+	// AdvertiseIP is the address other members should gossip with.
+	AdvertiseIP net.IP
+	// Cluster is the name of the cluster. Members only gossip within a cluster.
+	Cluster string
+	// Key, if set, is used to derive the key that encrypts and authenticates gossip.
+	Key []byte
+	// Join are the gossip host:port addresses of existing members to join through.
+	Join []string
+}
+
+// Gossip maintains the membership of a cluster of workers using SWIM-style gossip: members probe each other over UDP,
+// failed probes make a member suspect, and suspected members that do not refute it with a higher incarnation number
+// are declared dead.
+type Gossip struct {
+	list *memberlist.Memberlist
+
+	mu       sync.Mutex
+	departed map[string]departure
+}
+
+type departure struct {
+	node *memberlist.Node
+	at   time.Time
+}
+
+// gossipMeta is the metadata each member shares about itself.
+type gossipMeta struct {
+	Addr    string `json:"addr"`
+	Cluster string `json:"cluster"`
+}
+
+// JoinGossip starts gossiping and joins any of the members in config.Join.
+func JoinGossip(config GossipConfig) (*Gossip, error) {
+	meta, err := json.Marshal(gossipMeta{Addr: config.Addr, Cluster: config.Cluster})
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Gossip{departed: make(map[string]departure)}
+
+	mc := memberlist.DefaultLANConfig()
+	mc.Name = config.Addr
+	mc.BindPort = config.BindPort
+	mc.AdvertisePort = config.BindPort
+	if config.AdvertiseIP != nil {
+		mc.AdvertiseAddr = config.AdvertiseIP.String()
+	}
+	mc.Label = "sprinkle/" + config.Cluster
+	if len(config.Key) != 0 {
+		key := sha256.Sum256(config.Key)
+		mc.SecretKey = key[:]
+	}
+	mc.Delegate = metaDelegate(meta)
+	mc.Events = g
+	mc.LogOutput = glogWriter{}
+
+	list, err := memberlist.Create(mc)
+	if err != nil {
+		return nil, err
+	}
+	g.list = list
+
+	if len(config.Join) != 0 {
+		n, err := list.Join(config.Join)
+		if err != nil {
+			glog.Warningf("failed to join gossip via %v: %s", config.Join, err)
+		} else {
+			glog.Infof("joined gossip via %d of %v", n, config.Join)
+		}
+	}
+	return g, nil
+}
+
+// Leave announces that this member is leaving and stops gossiping.
+func (g *Gossip) Leave(timeout time.Duration) error {
+	if err := g.list.Leave(timeout); err != nil {
+		return err
+	}
+	return g.list.Shutdown()
+}
+
+// Members returns the current view of the cluster: live and suspect members, and those that died or left recently.
+func (g *Gossip) Members() []*pb.Member {
+	var members []*pb.Member
+	seen := make(map[string]bool)
+	for _, n := range g.list.Members() {
+		seen[n.Name] = true
+		members = append(members, member(n))
+	}
+
+	g.mu.Lock()
+	for name, d := range g.departed {
+		if time.Since(d.at) > gossipRetention {
+			delete(g.departed, name)
+			continue
+		}
+		if !seen[name] {
+			members = append(members, member(d.node))
+		}
+	}
+	g.mu.Unlock()
+
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+func member(n *memberlist.Node) *pb.Member {
+	var meta gossipMeta
+	if err := json.Unmarshal(n.Meta, &meta); err != nil {
+		glog.Warningf("malformed gossip metadata for %s: %s", n.Name, err)
+	}
+
+	m := &pb.Member{
+		Name:       n.Name,
+		Addr:       meta.Addr,
+		GossipAddr: n.Address(),
+	}
+	switch n.State {
+	case memberlist.StateAlive:
+		m.State = pb.Member_STATE_ALIVE
+	case memberlist.StateSuspect:
+		m.State = pb.Member_STATE_SUSPECT
+	case memberlist.StateDead:
+		m.State = pb.Member_STATE_DEAD
+	case memberlist.StateLeft:
+		m.State = pb.Member_STATE_LEFT
+	}
+	return m
+}
+
+// NotifyJoin implements memberlist.EventDelegate.
+func (g *Gossip) NotifyJoin(n *memberlist.Node) {
+	glog.Infof("gossip member %s joined", n.Name)
+	g.mu.Lock()
+	delete(g.departed, n.Name)
+	g.mu.Unlock()
+}
+
+// NotifyLeave implements memberlist.EventDelegate. It is called both when a member leaves and when it is declared
+// dead.
+func (g *Gossip) NotifyLeave(n *memberlist.Node) {
+	glog.Infof("gossip member %s departed", n.Name)
+	node := *n
+	g.mu.Lock()
+	g.departed[n.Name] = departure{node: &node, at: time.Now()}
+	g.mu.Unlock()
+}
+
+// NotifyUpdate implements memberlist.EventDelegate.
+func (g *Gossip) NotifyUpdate(n *memberlist.Node) {}
+
+// metaDelegate shares a fixed metadata blob and nothing else.
+type metaDelegate []byte
+
+func (d metaDelegate) NodeMeta(limit int) []byte {
+	if len(d) > limit {
+		glog.Errorf("gossip metadata exceeds %d bytes", limit)
+		return nil
+	}
+	return d
+}
+
+func (d metaDelegate) NotifyMsg([]byte)                           {}
+func (d metaDelegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (d metaDelegate) LocalState(join bool) []byte                { return nil }
+func (d metaDelegate) MergeRemoteState(buf []byte, join bool)     {}
+
+// glogWriter sends memberlist's log output to glog.
+type glogWriter struct{}
+
+func (glogWriter) Write(b []byte) (int, error) {
+	s := strings.TrimSpace(string(b))
+	switch {
+	case strings.Contains(s, "[ERR]"):
+		glog.Error(s)
+	case strings.Contains(s, "[WARN]"):
+		glog.Warning(s)
+	default:
+		glog.V(1).Info(s)
+	}
+	return len(b), nil
+}
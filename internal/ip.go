@@ -2,19 +2,38 @@ package internal
 
 import (
 	"errors"
+	"fmt"
 	"net"
 
 	"github.com/golang/glog"
 )
 
-// ExternalIP returns the external IP address of the current machine,
-// avoiding any loopback or down interfaces.
-func ExternalIP() (net.IP, error) {
-	ifaces, err := net.Interfaces()
-	if err != nil {
-		return nil, err
+// ExternalIP returns an external IP address of the current machine, avoiding any loopback or down interfaces and
+// link-local addresses. If ifname is set, only that interface is considered. family may be "ip4" or "ip6" to restrict
+// the address family; if it is empty, IPv4 addresses are preferred.
+func ExternalIP(ifname string, family string) (net.IP, error) {
+	switch family {
+	case "", "ip4", "ip6":
+	default:
+		return nil, fmt.Errorf("unknown address family %q", family)
 	}
 
+	var ifaces []net.Interface
+	if ifname != "" {
+		iface, err := net.InterfaceByName(ifname)
+		if err != nil {
+			return nil, err
+		}
+		ifaces = []net.Interface{*iface}
+	} else {
+		var err error
+		ifaces, err = net.Interfaces()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var ip6 net.IP
 	for _, iface := range ifaces {
 		if iface.Flags&net.FlagUp == 0 {
 			glog.Infof("skipping %q as it is down", iface.Name)
@@ -39,18 +58,40 @@ func ExternalIP() (net.IP, error) {
 				ip = v.IP
 			}
 
-			if ip == nil {
+			if ip == nil || ip.IsLinkLocalUnicast() {
 				continue
 			}
 
-			if ip.To4() == nil {
-				glog.Infof("skipping %q for no IPv4 address", iface.Name)
+			if ip.To4() != nil {
+				if family != "ip6" {
+					return ip, nil
+				}
 				continue
 			}
-			return ip, nil
+
+			if family == "ip6" {
+				return ip, nil
+			}
+			if ip6 == nil {
+				ip6 = ip
+			}
 		}
 	}
 
+	if ip6 != nil && family == "" {
+		return ip6, nil
+	}
+
+	if family != "" {
+		return nil, fmt.Errorf("no network interfaces with an %s address found", family)
+	}
 	return nil, errors.New("no network interfaces found")
 }
 
+// Family returns the address family ("ip4" or "ip6") of ip.
+func Family(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ip4"
+	}
+	return "ip6"
+}
@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ParseLabels parses a comma-separated list of key=value pairs.
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid label %q: expected key=value", kv)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// FormatLabels formats labels as a sorted, comma-separated list of key=value pairs.
+func FormatLabels(labels map[string]string) string {
+	kvs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/hashicorp/mdns"
+)
+
+const (
+	// MDNSService is the DNS-SD service type that workers advertise.
+	MDNSService = "_sprinkle._tcp"
+
+	mdnsDomain = "local"
+
+	txtCluster = "cluster="
+	txtVersion = "version="
+	txtLabel   = "label."
+)
+
+// MDNS discovers workers that advertise themselves via mDNS/DNS-SD.
+type MDNS struct {
+	// Cluster restricts discovery to workers advertising the same cluster.
+	Cluster string
+	// Iface is the name of the interface to browse on. If empty, the system default is used.
+	Iface string
+}
+
+// Discover implements Discoverer by querying for workers in the cluster.
+func (m *MDNS) Discover(ctx context.Context, opts DiscoverOptions) ([]WorkerInfo, error) {
+	params := &mdns.QueryParam{
+		Service: MDNSService,
+		Domain:  mdnsDomain,
+		Timeout: opts.timeout(),
+	}
+	if m.Iface != "" {
+		ifi, err := net.InterfaceByName(m.Iface)
+		if err != nil {
+			return nil, err
+		}
+		params.Interface = ifi
+	}
+
+	// The query drops entries it cannot send immediately.
+	entries := make(chan *mdns.ServiceEntry, 32)
+	params.Entries = entries
+
+	// The query cannot be cancelled, so may outlive this call.
+	errc := make(chan error, 1)
+	glog.Infof("browsing for %s.%s", MDNSService, mdnsDomain)
+	go func() {
+		errc <- mdns.Query(params)
+		close(entries)
+	}()
+
+	f := newFound(opts.Limit)
+	for !f.full() {
+		select {
+		case e, ok := <-entries:
+			if !ok {
+				if err := <-errc; err != nil {
+					return nil, err
+				}
+				return f.workers, nil
+			}
+			glog.Infof("mdns entry %s %v", e.Name, e.InfoFields)
+			if w, ok := m.worker(e); ok {
+				f.add(w)
+			}
+		case <-ctx.Done():
+			return f.workers, nil
+		}
+	}
+	return f.workers, nil
+}
+
+// worker returns the worker described by e, if it is in the cluster.
+func (m *MDNS) worker(e *mdns.ServiceEntry) (WorkerInfo, bool) {
+	w := WorkerInfo{Source: SourceMDNS, Labels: make(map[string]string)}
+	for _, f := range e.InfoFields {
+		switch {
+		case strings.HasPrefix(f, txtCluster):
+			w.Cluster = strings.TrimPrefix(f, txtCluster)
+		case strings.HasPrefix(f, txtVersion):
+			w.Version = strings.TrimPrefix(f, txtVersion)
+		case strings.HasPrefix(f, txtLabel):
+			if kv := strings.SplitN(strings.TrimPrefix(f, txtLabel), "=", 2); len(kv) == 2 {
+				w.Labels[kv[0]] = kv[1]
+			}
+		}
+	}
+	if w.Cluster != m.Cluster {
+		return WorkerInfo{}, false
+	}
+
+	ip := e.AddrV4
+	if ip == nil {
+		ip = e.AddrV6
+	}
+	if ip == nil {
+		return WorkerInfo{}, false
+	}
+	w.Addr = net.JoinHostPort(ip.String(), fmt.Sprintf("%d", e.Port))
+	return w, true
+}
+
+// MDNSAnnouncer announces a worker as an instance of MDNSService, with its cluster, labels and the sprinkle version in
+// the TXT records.
+type MDNSAnnouncer struct {
+	Cluster string
+	Labels  map[string]string
+	// Iface is the name of the interface to advertise on. If empty, the system default is used.
+	Iface string
+
+	server *mdns.Server
+}
+
+// Announce implements Announcer.
+func (a *MDNSAnnouncer) Announce(addr string) error {
+	h, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(h)
+	if ip == nil {
+		return fmt.Errorf("expected an ip address in %q", addr)
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return err
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	txt := []string{txtCluster + a.Cluster, txtVersion + Version}
+	for _, kv := range strings.Split(FormatLabels(a.Labels), ",") {
+		if kv != "" {
+			txt = append(txt, txtLabel+kv)
+		}
+	}
+
+	instance := fmt.Sprintf("%s-%d", host, port)
+	service, err := mdns.NewMDNSService(instance, MDNSService, mdnsDomain+".", "", port, []net.IP{ip}, txt)
+	if err != nil {
+		return err
+	}
+
+	config := &mdns.Config{Zone: service}
+	if a.Iface != "" {
+		ifi, err := net.InterfaceByName(a.Iface)
+		if err != nil {
+			return err
+		}
+		config.Iface = ifi
+	}
+
+	a.server, err = mdns.NewServer(config)
+	if err != nil {
+		return err
+	}
+	glog.Infof("advertising %s as %s.%s with %v", instance, MDNSService, mdnsDomain, txt)
+	return nil
+}
+
+// Close implements Announcer.
+func (a *MDNSAnnouncer) Close() error {
+	if a.server == nil {
+		return nil
+	}
+	return a.server.Shutdown()
+}
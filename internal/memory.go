@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemoryNetwork is an in-memory discovery Transport, for tests. Like UDP, datagrams to unknown addresses or to
+// listeners that have fallen behind are dropped.
+type MemoryNetwork struct {
+	mu    sync.Mutex
+	group map[*memoryConn]bool
+	conns map[string]*memoryConn
+	next  int
+}
+
+// NewMemoryNetwork returns an empty in-memory network.
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		group: make(map[*memoryConn]bool),
+		conns: make(map[string]*memoryConn),
+	}
+}
+
+func (n *MemoryNetwork) newConn() *memoryConn {
+	return &memoryConn{
+		network: n,
+		packets: make(chan []byte, 64),
+		closed:  make(chan struct{}),
+	}
+}
+
+// ListenGroup implements Transport.
+func (n *MemoryNetwork) ListenGroup() (PacketConn, error) {
+	c := n.newConn()
+	n.mu.Lock()
+	n.group[c] = true
+	n.mu.Unlock()
+	return c, nil
+}
+
+// Listen implements Transport.
+func (n *MemoryNetwork) Listen() (PacketConn, string, error) {
+	c := n.newConn()
+	n.mu.Lock()
+	n.next++
+	c.addr = net.JoinHostPort("memory", fmt.Sprintf("%d", n.next))
+	n.conns[c.addr] = c
+	n.mu.Unlock()
+	return c, c.addr, nil
+}
+
+// SendGroup implements Transport.
+func (n *MemoryNetwork) SendGroup(b []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for c := range n.group {
+		c.deliver(b)
+	}
+	return nil
+}
+
+// Send implements Transport.
+func (n *MemoryNetwork) Send(addr string, b []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if c, ok := n.conns[addr]; ok {
+		c.deliver(b)
+	}
+	return nil
+}
+
+type memoryConn struct {
+	network *MemoryNetwork
+	addr    string
+	packets chan []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *memoryConn) deliver(b []byte) {
+	p := make([]byte, len(b))
+	copy(p, b)
+	select {
+	case c.packets <- p:
+	default:
+	}
+}
+
+func (c *memoryConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case p := <-c.packets:
+		return copy(b, p), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.network.mu.Lock()
+		delete(c.network.group, c)
+		if c.addr != "" {
+			delete(c.network.conns, c.addr)
+		}
+		c.network.mu.Unlock()
+		close(c.closed)
+	})
+	return nil
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Multicast is a discovery Transport over UDP multicast, over either IPv4 or IPv6.
+type Multicast struct {
+	// Addr is the multicast group address, such as "239.192.0.1:9999" or "[ff15::5370]:9999".
+	Addr string
+	// Port is the local port on which to listen for acks.
+	Port int
+	// Iface is the name of the interface to send and listen on, and whose address is advertised for acks. If empty,
+	// the system default is used for sending and the first interface that supports multicast for listening.
+	Iface string
+}
+
+func (m *Multicast) group() (*net.UDPAddr, error) {
+	// Sanity checks
+	if m.Addr == "" {
+		return nil, errors.New("expected valid addr")
+	}
+
+	udpaddr, err := net.ResolveUDPAddr("udp", m.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !udpaddr.IP.IsMulticast() {
+		return nil, fmt.Errorf("%q is not multicast", m.Addr)
+	}
+	return udpaddr, nil
+}
+
+// ListenGroup implements Transport.
+func (m *Multicast) ListenGroup() (PacketConn, error) {
+	udpaddr, err := m.group()
+	if err != nil {
+		return nil, err
+	}
+
+	ifi, err := multicastInterface(m.Iface)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := net.ListenMulticastUDP(udpaddr.Network(), ifi, udpaddr)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Listen implements Transport. The returned address is of the same family as the group, so that acks can reach it.
+func (m *Multicast) Listen() (PacketConn, string, error) {
+	udpaddr, err := m.group()
+	if err != nil {
+		return nil, "", err
+	}
+
+	ip, err := ExternalIP(m.Iface, Family(udpaddr.IP))
+	if err != nil {
+		return nil, "", err
+	}
+
+	c, err := net.ListenUDP("udp", &net.UDPAddr{Port: m.Port})
+	if err != nil {
+		return nil, "", err
+	}
+	port := c.LocalAddr().(*net.UDPAddr).Port
+	return c, net.JoinHostPort(ip.String(), fmt.Sprintf("%d", port)), nil
+}
+
+// SendGroup implements Transport.
+func (m *Multicast) SendGroup(b []byte) error {
+	udpaddr, err := m.group()
+	if err != nil {
+		return err
+	}
+
+	pc, err := net.DialUDP("udp", nil, udpaddr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	if m.Iface != "" {
+		if err := setMulticastInterface(pc, udpaddr.IP, m.Iface); err != nil {
+			return err
+		}
+	}
+
+	_, err = pc.Write(b)
+	return err
+}
+
+// Send implements Transport.
+func (m *Multicast) Send(addr string, b []byte) error {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	rc, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = rc.Write(b)
+	return err
+}
+
+// multicastInterface returns the named interface, or the first that supports multicast if name is empty.
+func multicastInterface(name string) (*net.Interface, error) {
+	if name != "" {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		if ifi.Flags&net.FlagMulticast == 0 {
+			return nil, fmt.Errorf("iface %q does not support multicast", name)
+		}
+		return ifi, nil
+	}
+
+	// iface was not provided: search for the first multicast-supporting iface
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagMulticast != 0 {
+			return &ifi, nil
+		}
+	}
+	return nil, errors.New("no multicast interfaces found")
+}
+
+// setMulticastInterface makes pc send multicast traffic for group out of the named interface.
+func setMulticastInterface(pc *net.UDPConn, group net.IP, name string) error {
+	ifi, err := multicastInterface(name)
+	if err != nil {
+		return err
+	}
+	if group.To4() != nil {
+		return ipv4.NewPacketConn(pc).SetMulticastInterface(ifi)
+	}
+	return ipv6.NewPacketConn(pc).SetMulticastInterface(ifi)
+}
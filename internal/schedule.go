@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"sort"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+// Candidate is a worker that a job may be placed on.
+type Candidate struct {
+	Addr   string
+	Status *pb.StatusResponse
+}
+
+// Matches reports whether labels has every key in constraints with the same value. An empty constraint value
+// matches any value.
+func Matches(labels, constraints map[string]string) bool {
+	for k, v := range constraints {
+		got, ok := labels[k]
+		if !ok || v != "" && got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Schedule orders the candidates that can run a job needing ram, and whose labels satisfy constraints, from best to
+// worst. Draining candidates are skipped. The best candidate has the least free RAM that still fits the job,
+// leaving workers with more free RAM for larger jobs.
+func Schedule(cs []Candidate, ram uint64, constraints map[string]string) []Candidate {
+	var fit []Candidate
+	for _, c := range cs {
+		if c.Status == nil || c.Status.Draining || c.Status.FreeRam <= ram || !Matches(c.Status.Labels, constraints) {
+			continue
+		}
+		fit = append(fit, c)
+	}
+	sort.SliceStable(fit, func(i, j int) bool {
+		return fit[i].Status.FreeRam < fit[j].Status.FreeRam
+	})
+	return fit
+}
@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	pb "github.com/dominichamon/sprinkle/api/sprinkle"
+)
+
+// seedTimeout is how long to wait for a seed to accept a registration.
+const seedTimeout = 5 * time.Second
+
+// ParseSeeds returns the union of the comma-separated host:port addresses in list and those in the file at path, one
+// per line. Blank lines and lines starting with '#' in the file are ignored. Either may be empty.
+func ParseSeeds(list string, path string) ([]string, error) {
+	var seeds []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			seeds = append(seeds, s)
+		}
+	}
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			s := strings.TrimSpace(scanner.Text())
+			if s == "" || strings.HasPrefix(s, "#") {
+				continue
+			}
+			seeds = append(seeds, s)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range seeds {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			return nil, fmt.Errorf("invalid seed %q: %s", s, err)
+		}
+	}
+	return seeds, nil
+}
+
+// Seeds discovers workers by asking each of a static list of seed workers for the workers that have registered with
+// it or that it knows to be alive through gossip.
+type Seeds struct {
+	// Addrs are the host:port addresses of the seeds.
+	Addrs []string
+	// Cluster restricts discovery to workers in the same cluster.
+	Cluster string
+}
+
+// Discover implements Discoverer. Each responsive seed is reported along with the workers it knows about.
+func (s *Seeds) Discover(ctx context.Context, opts DiscoverOptions) ([]WorkerInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.timeout())
+	defer cancel()
+
+	results := make(chan []WorkerInfo, len(s.Addrs))
+	for _, seed := range s.Addrs {
+		go func(seed string) {
+			results <- s.ask(ctx, seed)
+		}(seed)
+	}
+
+	f := newFound(opts.Limit)
+	for range s.Addrs {
+		for _, w := range <-results {
+			if f.add(w) {
+				cancel()
+			}
+		}
+	}
+	return f.workers, nil
+}
+
+// ask returns the seed, if it responds, and the workers it knows about.
+func (s *Seeds) ask(ctx context.Context, seed string) []WorkerInfo {
+	w, err := DialWorker(seed)
+	if err != nil {
+		glog.Errorf("failed to connect to seed %s: %s", seed, err)
+		return nil
+	}
+	defer w.Close()
+
+	resp, err := w.Client.Peers(ctx, &pb.PeersRequest{Cluster: s.Cluster})
+	if err != nil {
+		glog.Warningf("failed to get peers from seed %s: %s", seed, err)
+		return nil
+	}
+	glog.Infof("seed %s has peers %v", seed, resp.Addr)
+
+	ws := []WorkerInfo{{Addr: seed, Cluster: s.Cluster, Source: SourceSeed}}
+	for _, a := range resp.Addr {
+		ws = append(ws, WorkerInfo{Addr: a, Cluster: s.Cluster, Source: SourceSeed})
+	}
+
+	members, err := w.Client.Members(ctx, &pb.MembersRequest{})
+	if err != nil {
+		glog.Warningf("failed to get members from seed %s: %s", seed, err)
+		return ws
+	}
+	for _, m := range members.Members {
+		if m.State == pb.Member_STATE_ALIVE && m.Addr != "" {
+			ws = append(ws, WorkerInfo{Addr: m.Addr, Cluster: s.Cluster, Source: SourceGossip})
+		}
+	}
+	return ws
+}
+
+// Registrar announces a worker by periodically registering it with each of a static list of seed workers, so that
+// clients which cannot use multicast can find it through the seeds.
+type Registrar struct {
+	// Seeds are the host:port addresses of the seeds.
+	Seeds   []string
+	Cluster string
+	// Interval is the time between registrations.
+	Interval time.Duration
+
+	stop chan struct{}
+}
+
+// Announce implements Announcer.
+func (r *Registrar) Announce(addr string) error {
+	if len(r.Seeds) == 0 {
+		return errors.New("expected seeds to register with")
+	}
+	r.stop = make(chan struct{})
+
+	go func() {
+		tick := time.NewTicker(r.Interval)
+		defer tick.Stop()
+		for {
+			for _, seed := range r.Seeds {
+				r.register(seed, addr)
+			}
+			select {
+			case <-tick.C:
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *Registrar) register(seed, addr string) {
+	w, err := DialWorker(seed)
+	if err != nil {
+		glog.Errorf("failed to connect to seed %s: %s", seed, err)
+		return
+	}
+	defer w.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), seedTimeout)
+	defer cancel()
+
+	if _, err := w.Client.Register(ctx, &pb.RegisterRequest{Addr: addr, Cluster: r.Cluster}); err != nil {
+		glog.Warningf("failed to register with seed %s: %s", seed, err)
+	}
+}
+
+// Close implements Announcer.
+func (r *Registrar) Close() error {
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+	return nil
+}
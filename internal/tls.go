@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSFiles are the paths to the PEM files used to secure RPCs between workers and their clients.
+type TLSFiles struct {
+	// Cert and Key are this node's certificate and private key.
+	Cert, Key string
+	// CA is the certificate authority that peers' certificates must be signed by.
+	CA string
+}
+
+// Enabled reports whether any TLS files are configured.
+func (f TLSFiles) Enabled() bool {
+	return f.Cert != "" || f.Key != "" || f.CA != ""
+}
+
+func (f TLSFiles) certificates() ([]tls.Certificate, error) {
+	if f.Cert == "" && f.Key == "" {
+		return nil, nil
+	}
+	if f.Cert == "" || f.Key == "" {
+		return nil, errors.New("expected both a certificate and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+	if err != nil {
+		return nil, err
+	}
+	return []tls.Certificate{cert}, nil
+}
+
+func (f TLSFiles) pool() (*x509.CertPool, error) {
+	if f.CA == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(f.CA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %q", f.CA)
+	}
+	return pool, nil
+}
+
+// ServerConfig returns the TLS configuration for a worker serving RPCs. If CA is set, clients must present a
+// certificate signed by it.
+func (f TLSFiles) ServerConfig() (*tls.Config, error) {
+	certs, err := f.certificates()
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("serving TLS requires a certificate and key")
+	}
+
+	pool, err := f.pool()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: certs,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if pool != nil {
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientConfig returns the TLS configuration for connecting to workers. If CA is set, workers' certificates are
+// verified against it rather than the system roots. If Cert and Key are set they are presented to workers that
+// require client certificates.
+func (f TLSFiles) ClientConfig() (*tls.Config, error) {
+	certs, err := f.certificates()
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := f.pool()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: certs,
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// TokenEnv is the environment variable from which a bearer token is read if none is given explicitly.
+const TokenEnv = "SPRINKLE_TOKEN"
+
+// DefaultTokenFile returns the path of the file from which a bearer token is read if none is given explicitly or
+// in the environment.
+func DefaultTokenFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sprinkle", "token")
+}
+
+// LoadToken returns the bearer token to present to workers. The token is taken from, in order of preference, the
+// given token, the TokenEnv environment variable, or the file at path. An empty token is returned if none are set
+// or the file does not exist.
+func LoadToken(token, path string) (string, error) {
+	if token != "" {
+		return token, nil
+	}
+	if token := os.Getenv(TokenEnv); token != "" {
+		return token, nil
+	}
+	if path == "" {
+		return "", nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// WithToken returns a context that presents the given bearer token on RPCs made with it, in place of any token
+// set with SetToken.
+func WithToken(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
+type noTokenKey struct{}
+
+// WithoutToken returns a context that presents no bearer token on RPCs made with it, not even one set with
+// SetToken, for calls to workers that are not yet trusted with it.
+func WithoutToken(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noTokenKey{}, true)
+}
+
+func hasToken(ctx context.Context) bool {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	return ok && len(md.Get("authorization")) != 0
+}
+
+// defaultToken adds the token set with SetToken to RPCs that do not already carry one.
+func defaultToken(ctx context.Context) context.Context {
+	if token == "" || hasToken(ctx) || ctx.Value(noTokenKey{}) != nil {
+		return ctx
+	}
+	return WithToken(ctx, token)
+}
+
+func unaryToken(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(defaultToken(ctx), method, req, reply, cc, opts...)
+}
+
+func streamToken(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(defaultToken(ctx), desc, cc, method, opts...)
+}
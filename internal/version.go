@@ -0,0 +1,5 @@
+package internal
+
+// Version is the version of sprinkle. It may be overridden at link time with
+// -ldflags "-X github.com/dominichamon/sprinkle/internal.Version=...".
+var Version = "dev"
@@ -1,14 +1,48 @@
 package internal
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"strconv"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/proto"
 
 	pb "github.com/dominichamon/sprinkle/api/sprinkle"
 )
 
+var (
+	creds = grpc.WithInsecure()
+	token string
+)
+
+// SetClientTLS makes subsequent connections to workers use TLS with the given configuration. A nil config
+// reverts to plaintext.
+func SetClientTLS(config *tls.Config) {
+	if config == nil {
+		creds = grpc.WithInsecure()
+		return
+	}
+	creds = grpc.WithTransportCredentials(credentials.NewTLS(config))
+}
+
+// SetToken sets the bearer token presented on RPCs to workers, unless the RPC's context carries its own from
+// WithToken. An empty token presents none.
+func SetToken(t string) {
+	token = t
+}
+
+func dialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		creds,
+		grpc.WithUnaryInterceptor(unaryToken),
+		grpc.WithStreamInterceptor(streamToken),
+	}
+}
+
 type Worker struct {
 	Id string
 
@@ -20,8 +54,25 @@ func (w *Worker) Close() error {
 	return w.conn.Close()
 }
 
+// ListJobs returns all of the worker's jobs that match the request's filter, following pages until the last.
+func (w *Worker) ListJobs(ctx context.Context, req *pb.ListJobsRequest) ([]*pb.JobResponse, error) {
+	req = proto.Clone(req).(*pb.ListJobsRequest)
+	var jobs []*pb.JobResponse
+	for {
+		resp, err := w.Client.ListJobs(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, resp.Jobs...)
+		if resp.NextPageToken == "" {
+			return jobs, nil
+		}
+		req.PageToken = resp.NextPageToken
+	}
+}
+
 func NewWorker(host string, port int) (*Worker, error) {
-	conn, err := grpc.Dial(net.JoinHostPort(host, fmt.Sprintf("%d", port)), grpc.WithInsecure())
+	conn, err := grpc.Dial(net.JoinHostPort(host, fmt.Sprintf("%d", port)), dialOptions()...)
 	if err != nil {
 		return nil, err
 	}
@@ -31,3 +82,18 @@ func NewWorker(host string, port int) (*Worker, error) {
 		Client: pb.NewWorkerClient(conn),
 	}, nil
 }
+
+// DialWorker connects to the worker at the given host:port address.
+func DialWorker(addr string) (*Worker, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := strconv.ParseInt(port, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWorker(host, int(p))
+}